@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"shop/mailer"
+	"shop/models"
+	"strconv"
+	"time"
+)
+
+// erasureGracePeriod is how long a requested account deletion can still be
+// cancelled before the personal data is anonymized.
+const erasureGracePeriod = 30 * 24 * time.Hour
+
+type OrderExport struct {
+	ID              int                   `json:"id"`
+	TotalAmount     float64               `json:"total_amount"`
+	Status          string                `json:"status"`
+	CreatedAt       time.Time             `json:"created_at"`
+	ShippingAddress *models.PostalAddress `json:"shipping_address"`
+	BillingAddress  *models.PostalAddress `json:"billing_address"`
+	Items           []models.OrderItem    `json:"items"`
+}
+
+// DataExport is everything the shop stores about the caller.
+type DataExport struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	Profile    PrivateProfile    `json:"profile"`
+	Addresses  []*models.Address `json:"addresses"`
+	Orders     []OrderExport     `json:"orders"`
+	Cart       []models.CartItem `json:"cart"`
+	Products   []*models.Product `json:"products"`
+}
+
+type ErasureResponse struct {
+	ErasureScheduledAt time.Time `json:"erasure_scheduled_at"`
+}
+
+func collectDataExport(user *models.User) (*DataExport, error) {
+	export := &DataExport{
+		ExportedAt: time.Now().UTC(),
+		Profile:    privateProfile(user),
+		Addresses:  []*models.Address{},
+		Orders:     []OrderExport{},
+		Cart:       []models.CartItem{},
+		Products:   []*models.Product{},
+	}
+
+	addresses, err := models.GetAddressesByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	export.Addresses = append(export.Addresses, addresses...)
+
+	orders, err := models.GetOrdersByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		items, err := models.GetOrderItemsByOrderID(order.ID)
+		if err != nil {
+			return nil, err
+		}
+		export.Orders = append(export.Orders, OrderExport{
+			ID:              order.ID,
+			TotalAmount:     order.TotalAmount,
+			Status:          order.Status,
+			CreatedAt:       order.CreatedAt,
+			ShippingAddress: order.ShippingAddress,
+			BillingAddress:  order.BillingAddress,
+			Items:           items,
+		})
+	}
+
+	cart, err := models.GetCartByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	export.Cart = append(export.Cart, cart...)
+
+	products, err := models.GetProductsByOwnerID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	export.Products = append(export.Products, products...)
+
+	return export, nil
+}
+
+// ExportDataHandler returns the caller's data as a single JSON document, or
+// as a ZIP archive with one JSON file per section when format=zip.
+func ExportDataHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil || user == nil {
+		http.Error(w, "Failed to export data", http.StatusInternalServerError)
+		return
+	}
+
+	export, err := collectDataExport(user)
+	if err != nil {
+		log.Println("Error collecting data export:", err)
+		http.Error(w, "Failed to export data", http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("shop-export-%d-%s", user.ID, export.ExportedAt.Format("20060102"))
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(export)
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, filename))
+		if err := writeExportArchive(w, export); err != nil {
+			log.Println("Error writing data export archive:", err)
+		}
+	default:
+		http.Error(w, "Unsupported format, use json or zip", http.StatusBadRequest)
+	}
+}
+
+func writeExportArchive(w http.ResponseWriter, export *DataExport) error {
+	archive := zip.NewWriter(w)
+
+	sections := []struct {
+		name string
+		data interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"addresses.json", export.Addresses},
+		{"orders.json", export.Orders},
+		{"cart.json", export.Cart},
+		{"products.json", export.Products},
+	}
+	for _, section := range sections {
+		file, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     section.name,
+			Method:   zip.Deflate,
+			Modified: export.ExportedAt,
+		})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(section.data); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// DeleteProfileHandler schedules the account for erasure. Until the grace
+// period ends the user can still log in and cancel it.
+func DeleteProfileHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil || user == nil {
+		http.Error(w, "Failed to delete profile", http.StatusInternalServerError)
+		return
+	}
+
+	scheduledAt, err := models.ScheduleUserErasure(user.ID, time.Now().Add(erasureGracePeriod))
+	if err != nil {
+		http.Error(w, "Failed to delete profile", http.StatusInternalServerError)
+		return
+	}
+
+	err = mailSender.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Your account is scheduled for deletion",
+		Body: fmt.Sprintf("Hi %s,\n\nYour account and personal data will be deleted on %s.\n\nIf you didn't request this or changed your mind, log in and cancel the deletion before then.\n",
+			user.Username, scheduledAt.UTC().Format("2 January 2006 15:04 MST")),
+	})
+	if err != nil {
+		log.Println("Error sending erasure notice:", err)
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditErasureRequest,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Details:    map[string]interface{}{"erasure_scheduled_at": scheduledAt},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ErasureResponse{ErasureScheduledAt: scheduledAt})
+}
+
+func CancelErasureHandler(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+	cancelled, err := models.CancelUserErasure(userID)
+	if err != nil {
+		http.Error(w, "Failed to cancel deletion", http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		http.Error(w, "No deletion is scheduled", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditErasureCancel, TargetType: "user", TargetID: strconv.Itoa(userID)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// StartErasureWorker anonymizes accounts whose grace period has ended, once
+// at startup and then every interval.
+func StartErasureWorker(interval time.Duration) {
+	go func() {
+		for {
+			runErasures()
+			time.Sleep(interval)
+		}
+	}()
+}
+
+func runErasures() {
+	userIDs, err := models.GetUserIDsDueForErasure(100)
+	if err != nil {
+		log.Println("Error loading scheduled erasures:", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		if err := models.AnonymizeUser(userID); err != nil {
+			log.Println("Error anonymizing user:", err)
+			continue
+		}
+		log.Printf("Anonymized user %d", userID)
+		writeAuditEvent(&models.AuditEvent{Action: AuditUserAnonymize, TargetType: "user", TargetID: strconv.Itoa(userID)})
+	}
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"shop/models"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type AddressRequest struct {
+	Label string `json:"label" validate:"max=50"`
+	models.PostalAddress
+	IsDefaultShipping bool `json:"is_default_shipping"`
+	IsDefaultBilling  bool `json:"is_default_billing"`
+}
+
+func (req *AddressRequest) Normalize() {
+	req.Label = strings.TrimSpace(req.Label)
+	normalizeAddress(&req.PostalAddress)
+}
+
+func (req *AddressRequest) Validate() []FieldError {
+	return validateAddress(&req.PostalAddress)
+}
+
+// countryAddressRule lists what a country's addresses need beyond the fields
+// every address has. Countries without a rule only get the common checks.
+type countryAddressRule struct {
+	PostalCode     *regexp.Regexp
+	RegionRequired bool
+}
+
+const maxAddressFieldLength = 200
+
+var countryCodePattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+var countryAddressRules = map[string]countryAddressRule{
+	"US": {PostalCode: regexp.MustCompile(`^\d{5}(-\d{4})?$`), RegionRequired: true},
+	"CA": {PostalCode: regexp.MustCompile(`^[A-Z]\d[A-Z] ?\d[A-Z]\d$`), RegionRequired: true},
+	"AU": {PostalCode: regexp.MustCompile(`^\d{4}$`), RegionRequired: true},
+	"GB": {PostalCode: regexp.MustCompile(`^[A-Z]{1,2}\d[A-Z\d]? ?\d[A-Z]{2}$`)},
+	"DE": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"FR": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"NL": {PostalCode: regexp.MustCompile(`^\d{4} ?[A-Z]{2}$`)},
+	"RU": {PostalCode: regexp.MustCompile(`^\d{6}$`)},
+	"UA": {PostalCode: regexp.MustCompile(`^\d{5}$`)},
+	"KZ": {PostalCode: regexp.MustCompile(`^\d{6}$`)},
+	// Ireland has Eircodes, but they are optional on mail.
+	"IE": {},
+}
+
+// normalizeAddress trims the fields and upper-cases the country and postal
+// code so they can be matched against the country rules.
+func normalizeAddress(a *models.PostalAddress) {
+	a.FullName = strings.TrimSpace(a.FullName)
+	a.Line1 = strings.TrimSpace(a.Line1)
+	a.Line2 = strings.TrimSpace(a.Line2)
+	a.City = strings.TrimSpace(a.City)
+	a.Region = strings.TrimSpace(a.Region)
+	a.PostalCode = strings.ToUpper(strings.TrimSpace(a.PostalCode))
+	a.Country = strings.ToUpper(strings.TrimSpace(a.Country))
+	a.Phone = strings.TrimSpace(a.Phone)
+}
+
+// validateAddress checks the fields every address needs and then the rules
+// of the address's country.
+func validateAddress(a *models.PostalAddress) []FieldError {
+	var errs []FieldError
+	fields := []struct {
+		name     string
+		value    string
+		required bool
+	}{
+		{"full_name", a.FullName, true},
+		{"line1", a.Line1, true},
+		{"line2", a.Line2, false},
+		{"city", a.City, true},
+		{"region", a.Region, false},
+		{"postal_code", a.PostalCode, false},
+		{"phone", a.Phone, false},
+	}
+	for _, f := range fields {
+		if f.required && f.value == "" {
+			errs = append(errs, FieldError{Field: f.name, Rule: "required", Message: "is required"})
+		} else if utf8.RuneCountInString(f.value) > maxAddressFieldLength {
+			errs = append(errs, FieldError{Field: f.name, Rule: "max", Message: fmt.Sprintf("must have at most %d characters", maxAddressFieldLength)})
+		}
+	}
+	if !countryCodePattern.MatchString(a.Country) {
+		errs = append(errs, FieldError{Field: "country", Rule: "country", Message: "must be an ISO 3166-1 alpha-2 code"})
+		return errs
+	}
+
+	rule, ok := countryAddressRules[a.Country]
+	if !ok {
+		return errs
+	}
+	if rule.RegionRequired && a.Region == "" {
+		errs = append(errs, FieldError{Field: "region", Rule: "required", Message: fmt.Sprintf("is required for %s addresses", a.Country)})
+	}
+	if rule.PostalCode != nil && !rule.PostalCode.MatchString(a.PostalCode) {
+		errs = append(errs, FieldError{Field: "postal_code", Rule: "postal_code", Message: fmt.Sprintf("is not valid for %s", a.Country)})
+	}
+	return errs
+}
+
+func addressIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	addressID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid address ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return addressID, true
+}
+
+func GetAddressesHandler(w http.ResponseWriter, r *http.Request) {
+	addresses, err := models.GetAddressesByUserID(currentPrincipal(r).UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch addresses", http.StatusInternalServerError)
+		return
+	}
+	if addresses == nil {
+		addresses = []*models.Address{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(addresses)
+}
+
+func GetAddressHandler(w http.ResponseWriter, r *http.Request) {
+	addressID, ok := addressIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	address, err := models.GetUserAddress(currentPrincipal(r).UserID, addressID)
+	if err != nil {
+		http.Error(w, "Failed to fetch address", http.StatusInternalServerError)
+		return
+	}
+	if address == nil {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(address)
+}
+
+func CreateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	var req AddressRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	address := &models.Address{
+		UserID:            currentPrincipal(r).UserID,
+		Label:             req.Label,
+		PostalAddress:     req.PostalAddress,
+		IsDefaultShipping: req.IsDefaultShipping,
+		IsDefaultBilling:  req.IsDefaultBilling,
+	}
+	if err := models.CreateAddress(address); err != nil {
+		http.Error(w, "Failed to create address", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(address)
+}
+
+func UpdateAddressHandler(w http.ResponseWriter, r *http.Request) {
+	addressID, ok := addressIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req AddressRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	address := &models.Address{
+		ID:                addressID,
+		UserID:            currentPrincipal(r).UserID,
+		Label:             req.Label,
+		PostalAddress:     req.PostalAddress,
+		IsDefaultShipping: req.IsDefaultShipping,
+		IsDefaultBilling:  req.IsDefaultBilling,
+	}
+	updated, err := models.UpdateAddress(address)
+	if err != nil {
+		http.Error(w, "Failed to update address", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(address)
+}
+
+func DeleteAddressHandler(w http.ResponseWriter, r *http.Request) {
+	addressID, ok := addressIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := models.DeleteAddress(currentPrincipal(r).UserID, addressID)
+	if err != nil {
+		http.Error(w, "Failed to delete address", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Address not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resolveOrderAddresses picks the shipping and billing addresses for a new
+// order: the ones requested by ID, otherwise the user's defaults. Billing
+// falls back to the shipping address. It writes the error response itself
+// and returns ok=false on failure.
+func resolveOrderAddresses(w http.ResponseWriter, userID int, shippingID, billingID *int) (shipping, billing *models.PostalAddress, ok bool) {
+	addresses, err := models.GetAddressesByUserID(userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch addresses", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	pick := func(id *int, isDefault func(*models.Address) bool) (*models.PostalAddress, bool) {
+		for _, address := range addresses {
+			if (id != nil && address.ID == *id) || (id == nil && isDefault(address)) {
+				snapshot := address.PostalAddress
+				return &snapshot, true
+			}
+		}
+		return nil, id == nil
+	}
+
+	shipping, found := pick(shippingID, func(a *models.Address) bool { return a.IsDefaultShipping })
+	if !found {
+		http.Error(w, "Shipping address not found", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if shipping == nil {
+		http.Error(w, "A shipping address is required", http.StatusBadRequest)
+		return nil, nil, false
+	}
+
+	billing, found = pick(billingID, func(a *models.Address) bool { return a.IsDefaultBilling })
+	if !found {
+		http.Error(w, "Billing address not found", http.StatusBadRequest)
+		return nil, nil, false
+	}
+	if billing == nil {
+		billing = shipping
+	}
+
+	return shipping, billing, true
+}
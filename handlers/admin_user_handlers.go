@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"shop/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminUserView is the account as administrators see it.
+type AdminUserView struct {
+	PrivateProfile
+	SuspendedAt     *time.Time `json:"suspended_at"`
+	SuspendedReason string     `json:"suspended_reason,omitempty"`
+	AnonymizedAt    *time.Time `json:"anonymized_at,omitempty"`
+}
+
+type SuspendUserRequest struct {
+	Reason string `json:"reason" validate:"required,max=500"`
+}
+
+type ChangeRoleRequest struct {
+	Role string `json:"role" validate:"required"`
+}
+
+func adminUserView(user *models.User) AdminUserView {
+	return AdminUserView{
+		PrivateProfile:  privateProfile(user),
+		SuspendedAt:     user.SuspendedAt,
+		SuspendedReason: user.SuspendedReason,
+		AnonymizedAt:    user.AnonymizedAt,
+	}
+}
+
+// adminTargetUser loads the user named by the {id} route variable. It writes
+// the error response itself and returns nil on failure.
+func adminTargetUser(w http.ResponseWriter, r *http.Request) *models.User {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return nil
+	}
+
+	user, err := models.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Failed to get user", http.StatusInternalServerError)
+		return nil
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return nil
+	}
+	return user
+}
+
+// rejectSelf keeps administrators from suspending or demoting themselves,
+// which could leave the shop without an admin.
+func rejectSelf(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	if currentPrincipal(r).UserID == user.ID {
+		http.Error(w, "Administrators cannot do this to their own account", http.StatusConflict)
+		return true
+	}
+	return false
+}
+
+func AdminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	search := models.UserSearch{
+		Query:  strings.TrimSpace(query.Get("q")),
+		Role:   query.Get("role"),
+		Status: query.Get("status"),
+	}
+	switch search.Status {
+	case "", "active", "suspended", "pending_erasure", "anonymized":
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	page, ok := pageRequestFromQuery(w, r)
+	if !ok {
+		return
+	}
+
+	users, info, err := models.SearchUsers(search, page)
+	if err != nil {
+		if writeQueryError(w, err) {
+			return
+		}
+		http.Error(w, "Failed to search users", http.StatusInternalServerError)
+		return
+	}
+
+	views := make([]AdminUserView, 0, len(users))
+	for _, user := range users {
+		views = append(views, adminUserView(user))
+	}
+
+	writeList(w, r, views, info)
+}
+
+func AdminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminUserView(user))
+}
+
+func AdminGetUserOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	writeOrderList(w, r, user.ID)
+}
+
+func AdminGetUserProductsHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	writeProductList(w, r, func(filter []models.FilterCondition) []models.FilterCondition {
+		return ownerFilter(filter, user.ID)
+	})
+}
+
+func AdminSuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminTargetUser(w, r)
+	if user == nil || rejectSelf(w, r, user) {
+		return
+	}
+
+	var req SuspendUserRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	if err := models.SuspendUser(user.ID, strings.TrimSpace(req.Reason)); err != nil {
+		http.Error(w, "Failed to suspend user", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditUserSuspend,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Details:    map[string]interface{}{"reason": req.Reason},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func AdminUnsuspendUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	if err := models.UnsuspendUser(user.ID); err != nil {
+		http.Error(w, "Failed to unsuspend user", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditUserUnsuspend, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminForcePasswordResetHandler replaces the user's password with a random
+// one, logs out every session, revokes their API keys and emails a reset link,
+// so the account can only be used again after the owner picks a new password.
+func AdminForcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminTargetUser(w, r)
+	if user == nil {
+		return
+	}
+
+	randomPassword, err := generateToken(32)
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	passwordHash, err := HashPassword(randomPassword)
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	if err := models.ForcePasswordReset(user.ID, passwordHash); err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sendPasswordResetEmail(user); err != nil {
+		log.Println("Error sending password reset email:", err)
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditUserPasswordResetForced, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminChangeRoleHandler changes the user's role. Their sessions are revoked
+// so that the new permissions apply from the next login.
+func AdminChangeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user := adminTargetUser(w, r)
+	if user == nil || rejectSelf(w, r, user) {
+		return
+	}
+
+	var req ChangeRoleRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	exists, err := models.RoleExists(req.Role)
+	if err != nil {
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", []FieldError{
+			{Field: "role", Rule: "exists", Message: "unknown role"},
+		})
+		return
+	}
+
+	if req.Role != user.Role {
+		if err := models.UpdateUserRole(user.ID, req.Role); err != nil {
+			http.Error(w, "Failed to change role", http.StatusInternalServerError)
+			return
+		}
+		if err := models.RevokeUserTokenFamilies(user.ID); err != nil {
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(r, models.AuditEvent{
+			Action:     AuditUserRoleChange,
+			TargetType: "user",
+			TargetID:   strconv.Itoa(user.ID),
+			Changes:    map[string]models.AuditChange{"role": {From: user.Role, To: req.Role}},
+		})
+		user.Role = req.Role
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(adminUserView(user))
+}
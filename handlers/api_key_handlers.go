@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"shop/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API keys look like shop_<prefix>_<secret>. The prefix is stored in clear so
+// users can tell their keys apart; the whole key is only stored hashed.
+const apiKeyPrefix = "shop_"
+
+var errInvalidAPIKey = errors.New("invalid or expired API key")
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name" validate:"required,max=100"`
+	Scopes    []string   `json:"scopes" validate:"required,max=20"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func (req *CreateAPIKeyRequest) Normalize() {
+	req.Name = strings.TrimSpace(req.Name)
+}
+
+func (req *CreateAPIKeyRequest) Validate() []FieldError {
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return []FieldError{{Field: "expires_at", Rule: "future", Message: "must be in the future"}}
+	}
+	return nil
+}
+
+type CreateAPIKeyResponse struct {
+	*models.APIKey
+	Key string `json:"key"`
+}
+
+func authenticateAPIKey(plain string) (*Principal, error) {
+	key, err := models.GetAPIKeyByHash(hashToken(plain))
+	if err != nil {
+		log.Println("Error looking up API key:", err)
+		return nil, errors.New("unable to verify API key")
+	}
+	if key == nil {
+		return nil, errInvalidAPIKey
+	}
+
+	rolePermissions, err := models.GetRolePermissions(key.Role)
+	if err != nil {
+		log.Println("Error loading role permissions:", err)
+		return nil, errors.New("unable to verify API key")
+	}
+
+	if err := models.TouchAPIKey(key.ID); err != nil {
+		log.Println("Error updating API key last use:", err)
+	}
+
+	return &Principal{
+		UserID:   key.UserID,
+		Username: key.Username,
+		Role:     key.Role,
+		// A key never grants more than its owner's role currently allows.
+		Permissions: intersect(rolePermissions, key.Scopes),
+		APIKeyID:    key.ID,
+	}, nil
+}
+
+func intersect(a, b []string) []string {
+	set := make(map[string]bool, len(b))
+	for _, v := range b {
+		set[v] = true
+	}
+	var out []string
+	for _, v := range a {
+		if set[v] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func GetAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := models.GetAPIKeysByUserID(currentPrincipal(r).UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+
+	var req CreateAPIKeyRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	var errs []FieldError
+	for i, scope := range req.Scopes {
+		if !principal.Can(scope) {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("scopes[%d]", i), Rule: "allowed", Message: "scope not allowed: " + scope})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", errs)
+		return
+	}
+
+	prefix, err := generateToken(6)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	secret, err := generateToken(32)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	// The prefix must not contain the separator, so strip the URL-safe
+	// alphabet's "_" and "-" from it.
+	prefix = strings.NewReplacer("_", "x", "-", "x").Replace(prefix)
+	plain := apiKeyPrefix + prefix + "_" + secret
+
+	key := &models.APIKey{
+		UserID:    principal.UserID,
+		Name:      req.Name,
+		Prefix:    apiKeyPrefix + prefix,
+		KeyHash:   hashToken(plain),
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	}
+	err = models.CreateAPIKey(key)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditAPIKeyCreate,
+		TargetType: "api_key",
+		TargetID:   strconv.Itoa(key.ID),
+		Details:    map[string]interface{}{"name": key.Name, "scopes": key.Scopes},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: key, Key: plain})
+}
+
+func RevokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	keyID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := models.RevokeAPIKey(keyID, currentPrincipal(r).UserID)
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditAPIKeyRevoke, TargetType: "api_key", TargetID: strconv.Itoa(keyID)})
+	w.WriteHeader(http.StatusNoContent)
+}
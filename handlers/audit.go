@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"shop/models"
+	"strconv"
+	"time"
+)
+
+// Audit actions. Names are <target>.<verb>.
+const (
+	AuditLogin                   = "auth.login"
+	AuditLoginFailed             = "auth.login_failed"
+	AuditLoginLockout            = "auth.lockout"
+	AuditPasswordChange          = "user.password_change"
+	AuditPasswordChangeFailed    = "user.password_change_failed"
+	AuditPasswordReset           = "user.password_reset"
+	AuditProfileUpdate           = "user.profile_update"
+	AuditErasureRequest          = "user.erasure_request"
+	AuditErasureCancel           = "user.erasure_cancel"
+	AuditUserAnonymize           = "user.anonymize"
+	AuditTOTPEnable              = "user.2fa_enable"
+	AuditTOTPDisable             = "user.2fa_disable"
+	AuditUserSuspend             = "user.suspend"
+	AuditUserUnsuspend           = "user.unsuspend"
+	AuditUserRoleChange          = "user.role_change"
+	AuditUserPasswordResetForced = "user.password_reset_forced"
+	AuditAPIKeyCreate            = "api_key.create"
+	AuditAPIKeyRevoke            = "api_key.revoke"
+	AuditProductCreate           = "product.create"
+	AuditProductUpdate           = "product.update"
+	AuditProductDelete           = "product.delete"
+	AuditOrderStatusChange       = "order.status_change"
+	AuditOrderDelete             = "order.delete"
+	AuditCategoryCreate          = "category.create"
+	AuditCategoryUpdate          = "category.update"
+	AuditCategoryDelete          = "category.delete"
+	AuditProductCategoriesSet    = "product.categories_set"
+	AuditProductOptionsSet       = "product.options_set"
+	AuditProductVariantCreate    = "product_variant.create"
+	AuditProductVariantUpdate    = "product_variant.update"
+	AuditProductVariantDelete    = "product_variant.delete"
+	AuditImpersonationStart      = "user.impersonate"
+	AuditImpersonatedRequest     = "impersonation.request"
+)
+
+// storeAuditEvent saves an event to the audit log. Tests replace it to
+// capture events without a database.
+var storeAuditEvent = models.CreateAuditEvent
+
+// writeAuditEvent stores the event. Failures are logged rather than
+// returned: the audited action has already happened.
+func writeAuditEvent(event *models.AuditEvent) {
+	if err := storeAuditEvent(event); err != nil {
+		log.Printf("Error recording audit event %s: %v", event.Action, err)
+	}
+}
+
+// recordAudit stores an event for the current request. The actor defaults to
+// the authenticated principal and the IP to the caller's address. During an
+// impersonation the actor is the administrator, and the impersonated user is
+// added to the details.
+func recordAudit(r *http.Request, event models.AuditEvent) {
+	if event.ActorID == nil {
+		if principal := currentPrincipal(r); principal.Impersonated() {
+			actorID := principal.ImpersonatorID
+			event.ActorID = &actorID
+			event.ActorUsername = principal.ImpersonatorUsername
+			if event.Details == nil {
+				event.Details = make(map[string]interface{})
+			}
+			event.Details["impersonated_user_id"] = principal.UserID
+		} else if principal != nil {
+			actorID := principal.UserID
+			event.ActorID = &actorID
+			event.ActorUsername = principal.Username
+		}
+	}
+	if event.IP == "" {
+		event.IP = clientIP(r)
+	}
+	writeAuditEvent(&event)
+}
+
+// auditActor makes user the actor of an event, for requests that aren't
+// authenticated yet, such as logins.
+func auditActor(event *models.AuditEvent, user *models.User) {
+	actorID := user.ID
+	event.ActorID = &actorID
+	event.ActorUsername = user.Username
+}
+
+// auditLogin records a login attempt. user is nil when the username is
+// unknown; the attempted name is kept in the details either way.
+func auditLogin(r *http.Request, action, method, username string, user *models.User, reason string) {
+	event := models.AuditEvent{
+		Action:     action,
+		TargetType: "user",
+		Details:    map[string]interface{}{"method": method, "username": username},
+	}
+	if user != nil {
+		auditActor(&event, user)
+		event.TargetID = strconv.Itoa(user.ID)
+	}
+	if reason != "" {
+		event.Details["reason"] = reason
+	}
+	recordAudit(r, event)
+}
+
+// auditChanges returns the fields whose values differ between before and
+// after, for the changes column. Either side may be nil, for creations and
+// deletions.
+func auditChanges(before, after map[string]interface{}) map[string]models.AuditChange {
+	changes := make(map[string]models.AuditChange)
+	for field, to := range after {
+		from := before[field]
+		if !reflect.DeepEqual(from, to) {
+			changes[field] = models.AuditChange{From: from, To: to}
+		}
+	}
+	for field, from := range before {
+		if _, ok := after[field]; !ok && from != nil {
+			changes[field] = models.AuditChange{From: from}
+		}
+	}
+	return changes
+}
+
+func productAuditFields(product *models.Product) map[string]interface{} {
+	return map[string]interface{}{
+		"name":           product.Name,
+		"description":    product.Description,
+		"price":          product.Price,
+		"stock_quantity": product.StockQuantity,
+	}
+}
+
+// auditFilterFromQuery reads the filters shared by the listing and export
+// endpoints. from and to are RFC 3339 timestamps.
+func auditFilterFromQuery(w http.ResponseWriter, r *http.Request) (models.AuditFilter, bool) {
+	query := r.URL.Query()
+	filter := models.AuditFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("target_type"),
+		TargetID:   query.Get("target_id"),
+		IP:         query.Get("ip"),
+	}
+
+	var errs []FieldError
+	if v := query.Get("actor_id"); v != "" {
+		actorID, err := strconv.Atoi(v)
+		if err != nil || actorID < 1 {
+			errs = append(errs, FieldError{Field: "actor_id", Rule: "type", Message: "must be a positive integer"})
+		}
+		filter.ActorID = actorID
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"from", &filter.From},
+		{"to", &filter.To},
+	} {
+		if v := query.Get(p.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs = append(errs, FieldError{Field: p.name, Rule: "type", Message: "must be an RFC 3339 timestamp"})
+			}
+			*p.dst = t
+		}
+	}
+
+	if len(errs) > 0 {
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid query", errs)
+		return filter, false
+	}
+	return filter, true
+}
+
+// GetAuditEventsHandler lists audit events newest first.
+func GetAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, ok := auditFilterFromQuery(w, r)
+	if !ok {
+		return
+	}
+	page, ok := pageRequestFromQuery(w, r)
+	if !ok {
+		return
+	}
+
+	events, info, err := models.GetAuditEvents(filter, page)
+	if err != nil {
+		if writeQueryError(w, err) {
+			return
+		}
+		http.Error(w, "Failed to fetch audit events", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, r, events, info)
+}
+
+// auditExportBatchSize is how many events the export reads per query. The
+// database connection is free for other requests between batches.
+const auditExportBatchSize = 500
+
+// ExportAuditEventsHandler streams every matching event as JSON lines,
+// oldest first.
+func ExportAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, ok := auditFilterFromQuery(w, r)
+	if !ok {
+		return
+	}
+
+	page := models.PageRequest{Sort: []models.SortKey{{Field: "id"}}, Limit: auditExportBatchSize}
+	events, info, err := models.GetAuditEvents(filter, page)
+	if err != nil {
+		http.Error(w, "Failed to export audit events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-events.jsonl"`)
+
+	encoder := json.NewEncoder(w)
+	for {
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				log.Println("Error exporting audit events:", err)
+				return
+			}
+		}
+		if info.NextCursor == "" {
+			return
+		}
+
+		page.Cursor = info.NextCursor
+		events, info, err = models.GetAuditEvents(filter, page)
+		if err != nil {
+			// The status line has been sent already; all we can do is cut
+			// the stream short.
+			log.Println("Error exporting audit events:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"reflect"
+	"shop/models"
+	"testing"
+)
+
+func TestAuditChanges(t *testing.T) {
+	before := map[string]interface{}{"name": "Mug", "price": 5.0}
+	after := map[string]interface{}{"name": "Mug", "price": 6.0}
+
+	for name, tc := range map[string]struct {
+		before, after map[string]interface{}
+		want          map[string]models.AuditChange
+	}{
+		"create": {nil, before, map[string]models.AuditChange{
+			"name":  {From: nil, To: "Mug"},
+			"price": {From: nil, To: 5.0},
+		}},
+		"update": {before, after, map[string]models.AuditChange{
+			"price": {From: 5.0, To: 6.0},
+		}},
+		"delete": {before, nil, map[string]models.AuditChange{
+			"name":  {From: "Mug", To: nil},
+			"price": {From: 5.0, To: nil},
+		}},
+		"unchanged": {before, before, map[string]models.AuditChange{}},
+	} {
+		if got := auditChanges(tc.before, tc.after); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: auditChanges = %v, want %v", name, got, tc.want)
+		}
+	}
+}
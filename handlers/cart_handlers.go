@@ -1,28 +1,94 @@
 package handlers
 
 import (
-	"encoding/json"
 	"github.com/gorilla/mux"
 	"net/http"
 	"shop/models"
 	"strconv"
 )
 
+// maxCartQuantity bounds the quantity of a single cart line.
+const maxCartQuantity = 1000
+
+type UpdateCartItemRequest struct {
+	Quantity int `json:"quantity" validate:"min=1,max=1000"`
+}
+
+// variantIDParam reads the optional variant_id parameter that picks a cart
+// line for products with variants.
+func variantIDParam(w http.ResponseWriter, r *http.Request) (*int, bool) {
+	v := r.FormValue("variant_id")
+	if v == "" {
+		return nil, true
+	}
+	variantID, err := strconv.Atoi(v)
+	if err != nil || variantID < 1 {
+		http.Error(w, "Invalid variant ID", http.StatusBadRequest)
+		return nil, false
+	}
+	return &variantID, true
+}
+
+func sameVariant(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// checkCartVariant makes sure the product exists and that variantID is one
+// of its variants, or absent if it has none. It writes the error response
+// itself and returns false on failure.
+func checkCartVariant(w http.ResponseWriter, productID int, variantID *int) bool {
+	product, err := models.GetProductByID(productID)
+	if err != nil {
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+		return false
+	}
+	if product == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return false
+	}
+
+	variants, err := models.GetProductVariants([]int{productID})
+	if err != nil {
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+		return false
+	}
+	if variantID == nil {
+		if len(variants[productID]) > 0 {
+			http.Error(w, "variant_id is required for this product", http.StatusBadRequest)
+			return false
+		}
+		return true
+	}
+	for _, variant := range variants[productID] {
+		if variant.ID == *variantID {
+			return true
+		}
+	}
+	http.Error(w, "Variant not found", http.StatusNotFound)
+	return false
+}
+
 func GetCartHandler(w http.ResponseWriter, r *http.Request) {
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	principal := currentPrincipal(r)
+
+	page, ok := pageRequestFromQuery(w, r)
+	if !ok {
 		return
 	}
 
-	cart, err := models.GetCartByUserID(currentUser.ID)
+	cart, info, err := models.GetCartPage(principal.UserID, page)
 	if err != nil {
+		if writeQueryError(w, err) {
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(cart)
+	writeList(w, r, cart, info)
 }
 
 func AddProductToCartHandler(w http.ResponseWriter, r *http.Request) {
@@ -33,25 +99,30 @@ func AddProductToCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := currentPrincipal(r)
 
 	quantityStr := r.FormValue("quantity")
 	quantity := 1
 	if quantityStr != "" {
 		quantity, err = strconv.Atoi(quantityStr)
-		if err != nil {
+		if err != nil || quantity < 1 || quantity > maxCartQuantity {
 			http.Error(w, "Invalid quantity", http.StatusBadRequest)
 			return
 		}
 	}
 
+	variantID, ok := variantIDParam(w, r)
+	if !ok {
+		return
+	}
+	if !checkCartVariant(w, productID, variantID) {
+		return
+	}
+
 	cartItem := &models.CartItem{
-		UserID:    currentUser.ID,
+		UserID:    principal.UserID,
 		ProductID: productID,
+		VariantID: variantID,
 		Quantity:  quantity,
 	}
 
@@ -71,35 +142,28 @@ func UpdateCartItemHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var updateRequest struct {
-		Quantity int `json:"quantity"`
-	}
-	err = json.NewDecoder(r.Body).Decode(&updateRequest)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	variantID, ok := variantIDParam(w, r)
+	if !ok {
 		return
 	}
 
-	if updateRequest.Quantity < 1 {
-		updateRequest.Quantity = 1
-	}
-
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	var updateRequest UpdateCartItemRequest
+	if !decodeJSON(w, r, &updateRequest) {
 		return
 	}
 
-	carts, err := models.GetCartByUserID(currentUser.ID)
+	principal := currentPrincipal(r)
+
+	cart, err := models.GetCartByUserID(principal.UserID)
 	if err != nil {
 		http.Error(w, "Failed to get user's cart", http.StatusInternalServerError)
 		return
 	}
 
 	var cartItem *models.CartItem
-	for _, cart := range carts {
-		if item, err := models.GetCartItemByProductID(cart.ID, productID); err == nil {
-			cartItem = item
+	for i := range cart {
+		if cart[i].ProductID == productID && sameVariant(cart[i].VariantID, variantID) {
+			cartItem = &cart[i]
 			break
 		}
 	}
@@ -127,39 +191,41 @@ func RemoveProductFromCartHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	variantID, ok := variantIDParam(w, r)
+	if !ok {
 		return
 	}
 
-	cart, err := models.GetCartByUserID(currentUser.ID)
+	principal := currentPrincipal(r)
+
+	cart, err := models.GetCartByUserID(principal.UserID)
 	if err != nil {
 		http.Error(w, "Failed to get user's cart", http.StatusInternalServerError)
 		return
 	}
 
-	var targetIndex int = -1
-
-	for i, item := range cart {
-		if item.ProductID == productID {
-			targetIndex = i
+	var cartItem *models.CartItem
+	for i := range cart {
+		if cart[i].ProductID == productID && sameVariant(cart[i].VariantID, variantID) {
+			cartItem = &cart[i]
 			break
 		}
 	}
 
-	if targetIndex == -1 {
+	if cartItem == nil {
 		http.Error(w, "Product not found in cart", http.StatusNotFound)
 		return
 	}
 
-	updatedCart := append(cart[:targetIndex], cart[targetIndex+1:]...)
-
-	err = models.UpdateCartByUserID(currentUser.ID, updatedCart)
+	removed, err := models.RemoveCartItem(principal.UserID, cartItem.ID)
 	if err != nil {
 		http.Error(w, "Failed to remove product from cart", http.StatusInternalServerError)
 		return
 	}
+	if !removed {
+		http.Error(w, "Product not found in cart", http.StatusNotFound)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"shop/models"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type CategoryRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+	// Slug defaults to one derived from the name.
+	Slug     string `json:"slug" validate:"required,max=100,match=slug"`
+	ParentID *int   `json:"parent_id" validate:"omitempty,gt=0"`
+	Position int    `json:"position" validate:"min=0,max=100000"`
+}
+
+func (req *CategoryRequest) Normalize() {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Slug = strings.ToLower(strings.TrimSpace(req.Slug))
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
+	}
+}
+
+type ProductCategoriesRequest struct {
+	CategoryIDs []int `json:"category_ids" validate:"max=20"`
+}
+
+// CategoryResponse is a category with its subtree and its breadcrumb.
+type CategoryResponse struct {
+	*models.CategoryNode
+	Path []models.CategoryRef `json:"path"`
+}
+
+// slugify lower-cases s and joins its ASCII letters and digits with dashes.
+func slugify(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	return strings.Join(words, "-")
+}
+
+func categoryIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	categoryID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid category ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return categoryID, true
+}
+
+// checkCategoryParent makes sure the parent exists and, when moving the
+// category with ID categoryID, isn't inside its own subtree. It writes the
+// error response itself and returns false on failure.
+func checkCategoryParent(w http.ResponseWriter, parentID *int, categoryID int) bool {
+	if parentID == nil {
+		return true
+	}
+
+	parent, err := models.GetCategoryByID(*parentID)
+	if err != nil {
+		http.Error(w, "Failed to check parent category", http.StatusInternalServerError)
+		return false
+	}
+	if parent == nil {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", []FieldError{
+			{Field: "parent_id", Rule: "exists", Message: "does not exist"},
+		})
+		return false
+	}
+
+	if categoryID != 0 {
+		cycle, err := models.IsCategoryInSubtree(categoryID, *parentID)
+		if err != nil {
+			http.Error(w, "Failed to check parent category", http.StatusInternalServerError)
+			return false
+		}
+		if cycle {
+			writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", []FieldError{
+				{Field: "parent_id", Rule: "cycle", Message: "cannot be the category itself or one of its descendants"},
+			})
+			return false
+		}
+	}
+	return true
+}
+
+func categoryAuditFields(category *models.Category) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      category.Name,
+		"slug":      category.Slug,
+		"parent_id": category.ParentID,
+		"position":  category.Position,
+	}
+}
+
+// GetCategoriesHandler returns the whole category tree.
+func GetCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	categories, err := models.GetCategories()
+	if err != nil {
+		http.Error(w, "Failed to fetch categories", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.BuildCategoryTree(categories))
+}
+
+func GetCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	categoryID, ok := categoryIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	categories, err := models.GetCategories()
+	if err != nil {
+		http.Error(w, "Failed to fetch category", http.StatusInternalServerError)
+		return
+	}
+
+	var node *models.CategoryNode
+	pending := models.BuildCategoryTree(categories)
+	for len(pending) > 0 && node == nil {
+		if pending[0].ID == categoryID {
+			node = pending[0]
+		}
+		pending = append(pending[1:], pending[0].Children...)
+	}
+	if node == nil {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	path, err := models.GetCategoryPath(categoryID)
+	if err != nil {
+		http.Error(w, "Failed to fetch category", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CategoryResponse{CategoryNode: node, Path: path})
+}
+
+// GetCategoryProductsHandler lists the products in the category and all of
+// its descendants, with the same parameters as the product listing.
+func GetCategoryProductsHandler(w http.ResponseWriter, r *http.Request) {
+	categoryID, ok := categoryIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	category, err := models.GetCategoryByID(categoryID)
+	if err != nil {
+		http.Error(w, "Failed to fetch category", http.StatusInternalServerError)
+		return
+	}
+	if category == nil {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	writeProductList(w, r, func(filter []models.FilterCondition) []models.FilterCondition {
+		return append(filter, models.FilterCondition{Field: "category", Operator: "=", Value: strconv.Itoa(category.ID)})
+	})
+}
+
+func CreateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	var req CategoryRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !checkCategoryParent(w, req.ParentID, 0) {
+		return
+	}
+
+	category := &models.Category{
+		ParentID: req.ParentID,
+		Name:     req.Name,
+		Slug:     req.Slug,
+		Position: req.Position,
+	}
+	if err := models.CreateCategory(category); err != nil {
+		if models.IsUniqueViolation(err) {
+			http.Error(w, "A category with this slug already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to create category", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditCategoryCreate,
+		TargetType: "category",
+		TargetID:   strconv.Itoa(category.ID),
+		Changes:    auditChanges(nil, categoryAuditFields(category)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(category)
+}
+
+func UpdateCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	categoryID, ok := categoryIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var req CategoryRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	existing, err := models.GetCategoryByID(categoryID)
+	if err != nil {
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	if !checkCategoryParent(w, req.ParentID, categoryID) {
+		return
+	}
+
+	category := &models.Category{
+		ID:       categoryID,
+		ParentID: req.ParentID,
+		Name:     req.Name,
+		Slug:     req.Slug,
+		Position: req.Position,
+	}
+	updated, err := models.UpdateCategory(category)
+	if err != nil {
+		if models.IsUniqueViolation(err) {
+			http.Error(w, "A category with this slug already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update category", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditCategoryUpdate,
+		TargetType: "category",
+		TargetID:   strconv.Itoa(categoryID),
+		Changes:    auditChanges(categoryAuditFields(existing), categoryAuditFields(category)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(category)
+}
+
+// DeleteCategoryHandler deletes an empty-of-children category. Products in
+// it are only unassigned.
+func DeleteCategoryHandler(w http.ResponseWriter, r *http.Request) {
+	categoryID, ok := categoryIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	children, err := models.CountChildCategories(categoryID)
+	if err != nil {
+		http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+		return
+	}
+	if children > 0 {
+		http.Error(w, "Category has subcategories; move or delete them first", http.StatusConflict)
+		return
+	}
+
+	deleted, err := models.DeleteCategory(categoryID)
+	if err != nil {
+		http.Error(w, "Failed to delete category", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditCategoryDelete, TargetType: "category", TargetID: strconv.Itoa(categoryID)})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetProductCategoriesHandler replaces the categories of a product. Anyone
+// who may edit the product may categorize it.
+func SetProductCategoriesHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	product, err := models.GetProductByID(productID)
+	if err != nil {
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+		return
+	}
+	if product == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+	if !canManageProduct(currentPrincipal(r), product) {
+		http.Error(w, "You are not authorized to update this product", http.StatusForbidden)
+		return
+	}
+
+	var req ProductCategoriesRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	categoryIDs := []int{}
+	seen := make(map[int]bool)
+	for _, id := range req.CategoryIDs {
+		if !seen[id] {
+			seen[id] = true
+			categoryIDs = append(categoryIDs, id)
+		}
+	}
+
+	missing, err := models.GetMissingCategoryIDs(categoryIDs)
+	if err != nil {
+		http.Error(w, "Failed to update categories", http.StatusInternalServerError)
+		return
+	}
+	if len(missing) > 0 {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", []FieldError{
+			{Field: "category_ids", Rule: "exists", Message: fmt.Sprintf("unknown categories: %v", missing)},
+		})
+		return
+	}
+
+	if err := models.SetProductCategories(productID, categoryIDs); err != nil {
+		http.Error(w, "Failed to update categories", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductCategoriesSet,
+		TargetType: "product",
+		TargetID:   strconv.Itoa(productID),
+		Details:    map[string]interface{}{"category_ids": categoryIDs},
+	})
+
+	if err := attachProductDetails([]*models.Product{product}); err != nil {
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(product)
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"shop/mailer"
+	"shop/models"
+	"strings"
+	"time"
+)
+
+const emailVerificationTTL = 24 * time.Hour
+
+var mailSender mailer.Mailer = &mailer.FileMailer{Dir: "outbox"}
+
+func SetMailer(m mailer.Mailer) {
+	mailSender = m
+}
+
+// appBaseURL is where links in outgoing emails point to.
+func appBaseURL() string {
+	if base := os.Getenv("APP_BASE_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	return "http://localhost:8080"
+}
+
+func sendVerificationEmail(user *models.User) error {
+	plain, err := generateToken(32)
+	if err != nil {
+		return err
+	}
+
+	err = models.CreateEmailVerificationToken(&models.EmailVerificationToken{
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: hashToken(plain),
+		ExpiresAt: time.Now().Add(emailVerificationTTL),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", appBaseURL(), url.QueryEscape(plain))
+	return mailSender.Send(mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below:\n\n%s\n\nThe link expires in %d hours.\n",
+			user.Username, link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	plain := r.URL.Query().Get("token")
+	if plain == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	token, err := models.GetEmailVerificationTokenByHash(hashToken(plain))
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	if token == nil || token.UsedAt != nil || time.Now().After(token.ExpiresAt) {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	verified, err := models.ConsumeEmailVerificationToken(token)
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	if !verified {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "verified"})
+}
+
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil {
+		http.Error(w, "Failed to get user profile", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	if user.EmailVerifiedAt != nil {
+		http.Error(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+
+	err = sendVerificationEmail(user)
+	if err != nil {
+		log.Println("Error sending verification email:", err)
+		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
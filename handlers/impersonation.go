@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"shop/models"
+	"strconv"
+	"time"
+)
+
+// Impersonation lets support staff see the shop as a customer sees it: the
+// cart, orders, products and profile. The token can only reach the
+// read-only routes registered through Impersonable; account security
+// (sessions, API keys) and the personal data export stay out of reach.
+var impersonableRoutes = make(map[*mux.Route]bool)
+
+func Impersonable(route *mux.Route) *mux.Route {
+	impersonableRoutes[route] = true
+	return route
+}
+
+type ImpersonationResponse struct {
+	Token     string        `json:"token"`
+	ExpiresIn int           `json:"expires_in"`
+	User      AdminUserView `json:"user"`
+}
+
+// statusRecorder remembers the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// AdminImpersonateUserHandler issues a short-lived token that acts as the
+// user. It needs a login session, since the token is bound to it.
+func AdminImpersonateUserHandler(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+	if principal.SessionID == "" {
+		http.Error(w, "Impersonation requires a login session", http.StatusForbidden)
+		return
+	}
+
+	user := adminTargetUser(w, r)
+	if user == nil || rejectSelf(w, r, user) {
+		return
+	}
+	if user.AnonymizedAt != nil {
+		http.Error(w, "Account has been erased", http.StatusConflict)
+		return
+	}
+
+	permissions, err := models.GetRolePermissions(user.Role)
+	if err != nil {
+		http.Error(w, "Failed to start impersonation", http.StatusInternalServerError)
+		return
+	}
+	if containsString(permissions, PermUsersManage) {
+		http.Error(w, "Administrators cannot be impersonated", http.StatusForbidden)
+		return
+	}
+
+	token, err := CreateImpersonationToken(user, permissions, principal)
+	if err != nil {
+		http.Error(w, "Failed to start impersonation", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditImpersonationStart,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(user.ID),
+		Details:    map[string]interface{}{"expires_at": time.Now().Add(impersonationTokenTTL)},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ImpersonationResponse{
+		Token:     token,
+		ExpiresIn: int(impersonationTokenTTL.Seconds()),
+		User:      adminUserView(user),
+	})
+}
+
+// serveImpersonated serves a request made with an impersonation token,
+// refusing any route that isn't impersonable, and records it in the audit
+// log whatever the outcome.
+func serveImpersonated(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	principal := currentPrincipal(r)
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	allowed := impersonableRoutes[mux.CurrentRoute(r)]
+	if allowed {
+		next.ServeHTTP(rec, r)
+	} else {
+		http.Error(rec, "Not allowed while impersonating a user", http.StatusForbidden)
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditImpersonatedRequest,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(principal.UserID),
+		Details: map[string]interface{}{
+			"method":  r.Method,
+			"path":    r.URL.RequestURI(),
+			"status":  rec.status,
+			"blocked": !allowed,
+		},
+	})
+}
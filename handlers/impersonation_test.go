@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"shop/models"
+	"testing"
+)
+
+// impersonableSpec lists the routes support staff may use while acting as a
+// customer.
+var impersonableSpec = map[string]bool{
+	"GET /profile":                  true,
+	"GET /profile/{username}":       true,
+	"GET /products":                 true,
+	"GET /products/search":          true,
+	"GET /products/{id}":            true,
+	"GET /products/{id}/variants":   true,
+	"GET /categories":               true,
+	"GET /categories/{id}":          true,
+	"GET /categories/{id}/products": true,
+	"GET /myproducts":               true,
+	"GET /cart":                     true,
+	"GET /orders":                   true,
+	"GET /orders/{order_id}":        true,
+}
+
+func TestImpersonationReachesOnlyListedRoutes(t *testing.T) {
+	grants := seededRolePermissions(t)
+	withPrincipals(t, map[string]*Principal{
+		"impersonated": {UserID: 1, Role: "seller", Permissions: grants["seller"], ImpersonatorID: 2, ImpersonatorUsername: "support"},
+	})
+	var events []*models.AuditEvent
+	storeAuditEvent = func(event *models.AuditEvent) error {
+		events = append(events, event)
+		return nil
+	}
+	t.Cleanup(func() { storeAuditEvent = models.CreateAuditEvent })
+
+	router := stubbedRouter()
+
+	for _, rt := range routes {
+		key := rt.method + " " + rt.path
+		if rt.impersonable != impersonableSpec[key] {
+			t.Errorf("%s: impersonable = %v, want %v", key, rt.impersonable, impersonableSpec[key])
+		}
+
+		events = nil
+		r := httptest.NewRequest(rt.method, routeVariable.ReplaceAllString(rt.path, "1"), nil)
+		r.Header.Set("Authorization", "Bearer impersonated")
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, r)
+
+		allowed := impersonableSpec[key]
+		if allowed && w.Code != http.StatusOK {
+			t.Errorf("%s while impersonating: status = %d, want %d", key, w.Code, http.StatusOK)
+		}
+		if !allowed && w.Code != http.StatusForbidden {
+			t.Errorf("%s while impersonating: status = %d, want %d", key, w.Code, http.StatusForbidden)
+		}
+
+		if len(events) != 1 || events[0].Action != AuditImpersonatedRequest {
+			t.Errorf("%s while impersonating: audit events = %v, want one %s", key, events, AuditImpersonatedRequest)
+			continue
+		}
+		if events[0].Details["blocked"] != !allowed || *events[0].ActorID != 2 {
+			t.Errorf("%s while impersonating: audit event = %+v", key, events[0])
+		}
+	}
+}
@@ -1,43 +1,133 @@
 package handlers
 
 import (
+	"errors"
 	"github.com/golang-jwt/jwt"
+	"os"
+	"shop/models"
 	"time"
 )
 
-var jwtKey = []byte("your_secret_key")
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+	mfaTokenTTL     = 5 * time.Minute
+	// impersonationTokenTTL is short and the token can't be refreshed, so an
+	// impersonation has to be restarted deliberately.
+	impersonationTokenTTL = 10 * time.Minute
+)
+
+// Token purposes other than plain access. Tokens with a purpose are never
+// accepted by VerifyToken.
+const purposeMFA = "mfa"
 
 type Claims struct {
-	Username string `json:"username"`
+	Username    string   `json:"username"`
+	UserID      int      `json:"uid"`
+	FamilyID    string   `json:"fid"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"perms"`
+	Purpose     string   `json:"purpose,omitempty"`
+	// Actor is set on impersonation tokens and names the administrator
+	// acting as the user, like the act claim of RFC 8693.
+	Actor *ActorClaims `json:"act,omitempty"`
 	jwt.StandardClaims
 }
 
-func CreateToken(username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+type ActorClaims struct {
+	UserID   int    `json:"uid"`
+	Username string `json:"username"`
+}
+
+func CreateToken(user *models.User, permissions []string, familyID string) (string, error) {
+	now := time.Now()
+
+	claims := &Claims{
+		Username:    user.Username,
+		UserID:      user.ID,
+		FamilyID:    familyID,
+		Role:        user.Role,
+		Permissions: permissions,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    tokenIssuer(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(accessTokenTTL).Unix(),
+		},
+	}
+
+	return keyring.Sign(claims)
+}
+
+// CreateImpersonationToken issues an access token for user on behalf of the
+// impersonator. It belongs to the impersonator's session, so logging out or
+// suspending the impersonator ends the impersonation too.
+func CreateImpersonationToken(user *models.User, permissions []string, impersonator *Principal) (string, error) {
+	now := time.Now()
+
+	claims := &Claims{
+		Username:    user.Username,
+		UserID:      user.ID,
+		FamilyID:    impersonator.SessionID,
+		Role:        user.Role,
+		Permissions: permissions,
+		Actor: &ActorClaims{
+			UserID:   impersonator.UserID,
+			Username: impersonator.Username,
+		},
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    tokenIssuer(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(impersonationTokenTTL).Unix(),
+		},
+	}
+
+	return keyring.Sign(claims)
+}
+
+func tokenIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "shop"
+}
+
+func VerifyToken(tokenString string) (*Claims, error) {
+	return verifyTokenWithPurpose(tokenString, "")
+}
+
+// CreateMFAToken issues the short-lived challenge returned by the first login
+// step when the account has two-factor authentication enabled.
+func CreateMFAToken(user *models.User) (string, error) {
+	now := time.Now()
 
 	claims := &Claims{
-		Username: username,
+		Username: user.Username,
+		UserID:   user.ID,
+		Purpose:  purposeMFA,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
+			Issuer:    tokenIssuer(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(mfaTokenTTL).Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	return keyring.Sign(claims)
+}
+
+func VerifyMFAToken(tokenString string) (*Claims, error) {
+	return verifyTokenWithPurpose(tokenString, purposeMFA)
 }
 
-func VerifyToken(tokenString string) (string, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+func verifyTokenWithPurpose(tokenString, purpose string) (*Claims, error) {
+	token, err := keyring.ParseWithClaims(tokenString, &Claims{})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims.Username, nil
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.VerifyIssuer(tokenIssuer(), true) && claims.Purpose == purpose {
+		return claims, nil
 	} else {
-		return "", err
+		return nil, errors.New("invalid token")
 	}
 }
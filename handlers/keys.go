@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// KeyConfig describes one signing or verification key in the file pointed to
+// by JWT_KEYS_FILE. Symmetric keys use SecretFile (or Secret); asymmetric keys
+// use PEM files. A key without a private part is only used for verification,
+// which is how a retired key stays valid until its tokens expire.
+type KeyConfig struct {
+	ID             string `json:"kid"`
+	Algorithm      string `json:"alg"`
+	Secret         string `json:"secret,omitempty"`
+	SecretFile     string `json:"secret_file,omitempty"`
+	PrivateKeyFile string `json:"private_key_file,omitempty"`
+	PublicKeyFile  string `json:"public_key_file,omitempty"`
+}
+
+type KeyringConfig struct {
+	Active string      `json:"active"`
+	Keys   []KeyConfig `json:"keys"`
+}
+
+type signingKey struct {
+	id        string
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+type Keyring struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+var keyring *Keyring
+
+// InitKeyring loads the signing keys from the environment:
+//
+//	JWT_KEYS_FILE  JSON KeyringConfig with several keys and the active kid
+//	JWT_SECRET     single HS256 secret, used when no keys file is given
+//
+// Without either, a random secret is generated and tokens won't survive a
+// restart.
+func InitKeyring() error {
+	var config KeyringConfig
+
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("invalid keys file %s: %v", path, err)
+		}
+	} else {
+		secret := os.Getenv("JWT_SECRET")
+		if secret == "" {
+			log.Println("JWT_SECRET is not set, using a random signing key")
+			generated, err := generateToken(32)
+			if err != nil {
+				return err
+			}
+			secret = generated
+		}
+		config = KeyringConfig{
+			Active: "default",
+			Keys:   []KeyConfig{{ID: "default", Algorithm: "HS256", Secret: secret}},
+		}
+	}
+
+	k, err := NewKeyring(config)
+	if err != nil {
+		return err
+	}
+	keyring = k
+	return nil
+}
+
+func NewKeyring(config KeyringConfig) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*signingKey)}
+
+	for _, kc := range config.Keys {
+		if kc.ID == "" {
+			return nil, errors.New("key without kid")
+		}
+		if _, ok := k.keys[kc.ID]; ok {
+			return nil, fmt.Errorf("duplicate kid %q", kc.ID)
+		}
+		key, err := loadSigningKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", kc.ID, err)
+		}
+		k.keys[kc.ID] = key
+	}
+
+	active, ok := k.keys[config.Active]
+	if !ok {
+		return nil, fmt.Errorf("active key %q is not configured", config.Active)
+	}
+	if active.signKey == nil {
+		return nil, fmt.Errorf("active key %q has no private key", config.Active)
+	}
+	k.active = active
+
+	return k, nil
+}
+
+func loadSigningKey(kc KeyConfig) (*signingKey, error) {
+	method := jwt.GetSigningMethod(kc.Algorithm)
+	if method == nil || method == jwt.SigningMethodNone {
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Algorithm)
+	}
+	key := &signingKey{id: kc.ID, method: method}
+
+	if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+		secret := []byte(kc.Secret)
+		if kc.SecretFile != "" {
+			data, err := os.ReadFile(kc.SecretFile)
+			if err != nil {
+				return nil, err
+			}
+			secret = []byte(strings.TrimSpace(string(data)))
+		}
+		if len(secret) < 32 {
+			return nil, errors.New("HMAC secret must be at least 32 bytes")
+		}
+		key.signKey = secret
+		key.verifyKey = secret
+		return key, nil
+	}
+
+	if kc.PrivateKeyFile != "" {
+		data, err := os.ReadFile(kc.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey, key.verifyKey = private, &private.PublicKey
+		case *jwt.SigningMethodECDSA:
+			private, err := jwt.ParseECPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey, key.verifyKey = private, &private.PublicKey
+		case *jwt.SigningMethodEd25519:
+			private, err := jwt.ParseEdPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey, key.verifyKey = private, private.(ed25519.PrivateKey).Public()
+		}
+		return key, nil
+	}
+
+	if kc.PublicKeyFile != "" {
+		data, err := os.ReadFile(kc.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			key.verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(data)
+		case *jwt.SigningMethodECDSA:
+			key.verifyKey, err = jwt.ParseECPublicKeyFromPEM(data)
+		case *jwt.SigningMethodEd25519:
+			key.verifyKey, err = jwt.ParseEdPublicKeyFromPEM(data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	return nil, errors.New("no key material configured")
+}
+
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.active.method, claims)
+	token.Header["kid"] = k.active.id
+	return token.SignedString(k.active.signKey)
+}
+
+func (k *Keyring) ParseWithClaims(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := k.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		// The algorithm is pinned per key so a token can't pick a weaker one.
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.verifyKey, nil
+	})
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of every asymmetric key. HMAC secrets are
+// never published.
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	encode := base64.RawURLEncoding.EncodeToString
+
+	for _, key := range k.keys {
+		jwk := JWK{KeyID: key.id, Algorithm: key.method.Alg(), Use: "sig"}
+		switch pub := key.verifyKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encode(pub.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			jwk.KeyType = "EC"
+			jwk.Curve = pub.Curve.Params().Name
+			jwk.X = encode(pub.X.FillBytes(make([]byte, size)))
+			jwk.Y = encode(pub.Y.FillBytes(make([]byte, size)))
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = encode(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+
+	return set
+}
+
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(keyring.JWKS())
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"shop/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKey writes a fresh key pair for the algorithm as PEM files and returns
+// the configs for signing with it and for verifying only.
+func testKey(t *testing.T, kid, alg string) (signing, verifying KeyConfig) {
+	var public interface{}
+	var privateBlock string
+	var privateDER []byte
+
+	switch {
+	case strings.HasPrefix(alg, "HS"):
+		config := KeyConfig{ID: kid, Algorithm: alg, Secret: strings.Repeat(kid, 64)[:64]}
+		return config, config
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public = &key.PublicKey
+		privateBlock, privateDER = "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)
+	case strings.HasPrefix(alg, "ES"):
+		curve := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}[alg]
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public = &key.PublicKey
+		privateBlock = "EC PRIVATE KEY"
+		if privateDER, err = x509.MarshalECPrivateKey(key); err != nil {
+			t.Fatal(err)
+		}
+	case alg == "EdDSA":
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		public = pub
+		privateBlock = "PRIVATE KEY"
+		if privateDER, err = x509.MarshalPKCS8PrivateKey(key); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatalf("no test key for %s", alg)
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	signing = KeyConfig{ID: kid, Algorithm: alg, PrivateKeyFile: write("private.pem", privateBlock, privateDER)}
+	verifying = KeyConfig{ID: kid, Algorithm: alg, PublicKeyFile: write("public.pem", "PUBLIC KEY", publicDER)}
+	return signing, verifying
+}
+
+func newTestKeyring(t *testing.T, active string, keys ...KeyConfig) *Keyring {
+	k, err := NewKeyring(KeyringConfig{Active: active, Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func testClaims() *jwt.StandardClaims {
+	return &jwt.StandardClaims{Subject: "42", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+}
+
+func TestKeyringSignsAndVerifiesEveryAlgorithm(t *testing.T) {
+	active, _ := testKey(t, "active", "HS256")
+
+	for _, alg := range []string{"HS256", "HS384", "HS512", "RS256", "RS512", "PS256", "ES256", "ES384", "EdDSA"} {
+		signing, verifying := testKey(t, "k-"+alg, alg)
+		signer := newTestKeyring(t, signing.ID, signing)
+
+		tokenString, err := signer.Sign(testClaims())
+		if err != nil {
+			t.Errorf("%s: sign: %v", alg, err)
+			continue
+		}
+
+		// Asymmetric tokens verify with the public key alone.
+		for name, k := range map[string]*Keyring{
+			"signer":   signer,
+			"verifier": newTestKeyring(t, active.ID, active, verifying),
+		} {
+			claims := &jwt.StandardClaims{}
+			token, err := k.ParseWithClaims(tokenString, claims)
+			if err != nil || !token.Valid {
+				t.Errorf("%s: verify with %s keyring: %v", alg, name, err)
+				continue
+			}
+			if token.Header["kid"] != signing.ID || token.Header["alg"] != alg || claims.Subject != "42" {
+				t.Errorf("%s: header = %v, subject = %q", alg, token.Header, claims.Subject)
+			}
+		}
+	}
+}
+
+func TestKeyringSelectsKeyByKid(t *testing.T) {
+	oldSigning, oldVerifying := testKey(t, "2025-01", "ES256")
+	newSigning, _ := testKey(t, "2025-06", "RS256")
+
+	oldToken, err := newTestKeyring(t, oldSigning.ID, oldSigning).Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After the rotation the old key is kept for verification only.
+	rotated := newTestKeyring(t, newSigning.ID, newSigning, oldVerifying)
+	newToken, err := rotated.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tokenString := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := rotated.ParseWithClaims(tokenString, &jwt.StandardClaims{}); err != nil {
+			t.Errorf("%s token rejected: %v", name, err)
+		}
+	}
+	if token, _ := jwt.Parse(newToken, nil); token.Header["kid"] != newSigning.ID {
+		t.Errorf("new token kid = %v, want %s", token.Header["kid"], newSigning.ID)
+	}
+
+	// A kid pointing at another key, or at no key, doesn't verify.
+	oldKey, err := os.ReadFile(oldSigning.PrivateKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := jwt.ParseECPrivateKeyFromPEM(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, kid := range map[string]interface{}{"other key": newSigning.ID, "unknown key": "nope", "no kid": nil} {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, testClaims())
+		token.Header["kid"] = kid
+		tokenString, err := token.SignedString(private)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rotated.ParseWithClaims(tokenString, &jwt.StandardClaims{}); err == nil {
+			t.Errorf("%s: token accepted", name)
+		}
+	}
+
+	// The algorithm is pinned per key: an HMAC token keyed with the public
+	// EC key must not pass as signed by it.
+	publicPEM, err := os.ReadFile(oldVerifying.PublicKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	forged.Header["kid"] = oldVerifying.ID
+	forgedString, err := forged.SignedString(publicPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotated.ParseWithClaims(forgedString, &jwt.StandardClaims{}); err == nil {
+		t.Error("token with a swapped algorithm accepted")
+	}
+}
+
+func TestKeyringVerifiesWithTheKeyNamedByKid(t *testing.T) {
+	a, _ := testKey(t, "a", "HS256")
+	b, _ := testKey(t, "b", "HS256")
+
+	tokenString, err := newTestKeyring(t, a.ID, a).Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestKeyring(t, b.ID, b, a).ParseWithClaims(tokenString, &jwt.StandardClaims{}); err != nil {
+		t.Errorf("token rejected by a keyring holding its key: %v", err)
+	}
+
+	// Same algorithm, but the kid names a key that didn't sign the token.
+	mislabelled := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	mislabelled.Header["kid"] = b.ID
+	mislabelledString, err := mislabelled.SignedString([]byte(a.Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestKeyring(t, b.ID, b, a).ParseWithClaims(mislabelledString, &jwt.StandardClaims{}); err == nil {
+		t.Error("token verified with a key other than the one that signed it")
+	}
+}
+
+func TestKeyringRejectsRotatedOutKey(t *testing.T) {
+	retired, _ := testKey(t, "2024-01", "HS256")
+	current, _ := testKey(t, "2025-01", "HS256")
+
+	tokenString, err := newTestKeyring(t, retired.ID, retired).Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestKeyring(t, current.ID, current, retired).ParseWithClaims(tokenString, &jwt.StandardClaims{}); err != nil {
+		t.Errorf("token rejected while its key is still configured: %v", err)
+	}
+	if _, err := newTestKeyring(t, current.ID, current).ParseWithClaims(tokenString, &jwt.StandardClaims{}); err == nil {
+		t.Error("token signed with a rotated-out key accepted")
+	}
+}
+
+func TestNewKeyringRejectsBadConfigs(t *testing.T) {
+	signing, verifying := testKey(t, "k", "RS256")
+	for name, config := range map[string]KeyringConfig{
+		"unknown active":        {Active: "other", Keys: []KeyConfig{signing}},
+		"verify-only active":    {Active: "k", Keys: []KeyConfig{verifying}},
+		"duplicate kid":         {Active: "k", Keys: []KeyConfig{signing, signing}},
+		"missing kid":           {Active: "", Keys: []KeyConfig{{Algorithm: "HS256", Secret: strings.Repeat("s", 32)}}},
+		"short secret":          {Active: "k", Keys: []KeyConfig{{ID: "k", Algorithm: "HS256", Secret: "short"}}},
+		"none algorithm":        {Active: "k", Keys: []KeyConfig{{ID: "k", Algorithm: "none", Secret: strings.Repeat("s", 32)}}},
+		"no key material":       {Active: "k", Keys: []KeyConfig{{ID: "k", Algorithm: "RS256"}}},
+		"unsupported algorithm": {Active: "k", Keys: []KeyConfig{{ID: "k", Algorithm: "XS256", Secret: strings.Repeat("s", 32)}}},
+	} {
+		if _, err := NewKeyring(config); err == nil {
+			t.Errorf("%s: keyring accepted", name)
+		}
+	}
+}
+
+func TestVerifyTokenWithKeyring(t *testing.T) {
+	signing, _ := testKey(t, "k", "ES256")
+	previous := keyring
+	keyring = newTestKeyring(t, signing.ID, signing)
+	t.Cleanup(func() { keyring = previous })
+
+	user := &models.User{ID: 7, Username: "alice", Role: models.RoleCustomer}
+	tokenString, err := CreateToken(user, []string{PermCartRead}, "family-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := VerifyToken(tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 7 || claims.FamilyID != "family-1" || len(claims.Permissions) != 1 {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	mfaToken, err := CreateMFAToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyToken(mfaToken); err == nil {
+		t.Error("MFA challenge accepted as an access token")
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	rsaKey, _ := testKey(t, "rsa", "RS256")
+	ecKey, _ := testKey(t, "ec", "ES384")
+	_, edKey := testKey(t, "ed", "EdDSA")
+	hmacKey, _ := testKey(t, "hmac", "HS256")
+
+	previous := keyring
+	keyring = newTestKeyring(t, rsaKey.ID, rsaKey, ecKey, edKey, hmacKey)
+	t.Cleanup(func() { keyring = previous })
+
+	w := httptest.NewRecorder()
+	JWKSHandler(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("status = %d, headers = %v", w.Code, w.Header())
+	}
+	var set JWKSet
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sorted by kid, and the HMAC secret is never published.
+	var kids []string
+	for _, jwk := range set.Keys {
+		kids = append(kids, jwk.KeyID)
+	}
+	if strings.Join(kids, ",") != "ec,ed,rsa" {
+		t.Fatalf("kids = %v, want ec, ed, rsa", kids)
+	}
+
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	keys := keyring.keys
+
+	ec, ed, rs := set.Keys[0], set.Keys[1], set.Keys[2]
+
+	ecPublic := keys["ec"].verifyKey.(*ecdsa.PublicKey)
+	if ec.KeyType != "EC" || ec.Algorithm != "ES384" || ec.Curve != "P-384" || ec.Use != "sig" ||
+		len(decode(ec.X)) != 48 || new(big.Int).SetBytes(decode(ec.X)).Cmp(ecPublic.X) != 0 || new(big.Int).SetBytes(decode(ec.Y)).Cmp(ecPublic.Y) != 0 {
+		t.Errorf("EC JWK = %+v", ec)
+	}
+
+	edPublic := keys["ed"].verifyKey.(ed25519.PublicKey)
+	if ed.KeyType != "OKP" || ed.Algorithm != "EdDSA" || ed.Curve != "Ed25519" || string(decode(ed.X)) != string(edPublic) {
+		t.Errorf("Ed25519 JWK = %+v", ed)
+	}
+
+	rsaPublic := keys["rsa"].verifyKey.(*rsa.PublicKey)
+	if rs.KeyType != "RSA" || rs.Algorithm != "RS256" || rs.Use != "sig" ||
+		new(big.Int).SetBytes(decode(rs.N)).Cmp(rsaPublic.N) != 0 || new(big.Int).SetBytes(decode(rs.E)).Int64() != int64(rsaPublic.E) {
+		t.Errorf("RSA JWK = %+v", rs)
+	}
+}
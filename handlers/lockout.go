@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"shop/models"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptStore keeps consecutive login failure counters and lockouts. The
+// in-memory store is enough for a single instance; PostgresAttemptStore
+// shares the counters between instances.
+type AttemptStore interface {
+	LockedUntil(key string) (time.Time, error)
+	// Fail records a failed attempt and returns the number of consecutive
+	// failures within the failure window.
+	Fail(key string) (int, error)
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+// lockoutPolicy allows Free failures, then locks for Base, doubling with
+// every further failure up to Max.
+type lockoutPolicy struct {
+	Free int
+	Base time.Duration
+	Max  time.Duration
+}
+
+// failureWindow is how long a failure is remembered.
+const failureWindow = 24 * time.Hour
+
+var (
+	accountLockoutPolicy = lockoutPolicy{Free: 5, Base: 30 * time.Second, Max: 15 * time.Minute}
+	ipLockoutPolicy      = lockoutPolicy{Free: 20, Base: time.Minute, Max: time.Hour}
+)
+
+var attemptStore AttemptStore = NewMemoryAttemptStore()
+
+func SetAttemptStore(store AttemptStore) {
+	attemptStore = store
+}
+
+func (p lockoutPolicy) lockDuration(failures int) time.Duration {
+	if failures <= p.Free {
+		return 0
+	}
+	d := time.Duration(float64(p.Base) * math.Pow(2, float64(failures-p.Free-1)))
+	if d > p.Max || d <= 0 {
+		return p.Max
+	}
+	return d
+}
+
+type memoryAttempt struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*memoryAttempt
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]*memoryAttempt)}
+}
+
+func (s *MemoryAttemptStore) LockedUntil(key string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.attempts[key]; ok {
+		return a.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+func (s *MemoryAttemptStore) Fail(key string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	a, ok := s.attempts[key]
+	if !ok || now.Sub(a.lastFailure) > failureWindow {
+		a = &memoryAttempt{}
+		s.attempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+
+	// Drop stale entries now and then so per-IP keys don't pile up forever.
+	if len(s.attempts) > 10000 {
+		for k, v := range s.attempts {
+			if now.Sub(v.lastFailure) > failureWindow && now.After(v.lockedUntil) {
+				delete(s.attempts, k)
+			}
+		}
+	}
+
+	return a.failures, nil
+}
+
+func (s *MemoryAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.attempts[key]; ok {
+		a.lockedUntil = until
+	}
+	return nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+type PostgresAttemptStore struct{}
+
+func (PostgresAttemptStore) LockedUntil(key string) (time.Time, error) {
+	return models.GetLoginLockedUntil(key)
+}
+
+func (PostgresAttemptStore) Fail(key string) (int, error) {
+	return models.RecordLoginFailure(key, failureWindow)
+}
+
+func (PostgresAttemptStore) Lock(key string, until time.Time) error {
+	return models.LockLogin(key, until)
+}
+
+func (PostgresAttemptStore) Reset(key string) error {
+	return models.ResetLoginAttempts(key)
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only trusted when
+// TRUST_PROXY=true, i.e. when the app runs behind a reverse proxy that sets it.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type loginThrottle struct {
+	username   string
+	ip         string
+	accountKey string
+	ipKey      string
+}
+
+func newLoginThrottle(r *http.Request, username string) *loginThrottle {
+	ip := clientIP(r)
+	return &loginThrottle{
+		username:   username,
+		ip:         ip,
+		accountKey: "account:" + strings.ToLower(username),
+		ipKey:      "ip:" + ip,
+	}
+}
+
+// retryAfter returns how long the caller still has to wait, or zero.
+func (t *loginThrottle) retryAfter() time.Duration {
+	var wait time.Duration
+	for _, key := range []string{t.accountKey, t.ipKey} {
+		until, err := attemptStore.LockedUntil(key)
+		if err != nil {
+			log.Println("Error reading login lockout:", err)
+			continue
+		}
+		if d := time.Until(until); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (t *loginThrottle) fail() {
+	t.failKey(t.accountKey, accountLockoutPolicy)
+	t.failKey(t.ipKey, ipLockoutPolicy)
+}
+
+func (t *loginThrottle) failKey(key string, policy lockoutPolicy) {
+	failures, err := attemptStore.Fail(key)
+	if err != nil {
+		log.Println("Error recording login failure:", err)
+		return
+	}
+
+	d := policy.lockDuration(failures)
+	if d == 0 {
+		return
+	}
+
+	until := time.Now().Add(d)
+	if err := attemptStore.Lock(key, until); err != nil {
+		log.Println("Error locking login:", err)
+		return
+	}
+
+	log.Printf("Login locked for %s until %s after %d failures", key, until.Format(time.RFC3339), failures)
+	err = models.CreateLoginLockout(&models.LoginLockout{
+		Key:         key,
+		Username:    t.username,
+		IP:          t.ip,
+		Failures:    failures,
+		LockedUntil: until,
+	})
+	if err != nil {
+		log.Println("Error recording login lockout:", err)
+	}
+
+	writeAuditEvent(&models.AuditEvent{
+		Action:  AuditLoginLockout,
+		IP:      t.ip,
+		Details: map[string]interface{}{"key": key, "username": t.username, "failures": failures, "locked_until": until},
+	})
+}
+
+func (t *loginThrottle) succeed() {
+	if err := attemptStore.Reset(t.accountKey); err != nil {
+		log.Println("Error resetting login failures:", err)
+	}
+}
+
+func tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"shop/models"
+	"strings"
+)
+
+// Principal is the authenticated caller, resolved once per request by
+// AuthMiddleware from the bearer token claims.
+type Principal struct {
+	UserID      int
+	Username    string
+	SessionID   string
+	Role        string
+	Permissions []string
+	// APIKeyID is set when the caller authenticated with a personal API key
+	// instead of a session token.
+	APIKeyID int
+	// ImpersonatorID is set when an administrator is acting as this user.
+	ImpersonatorID       int
+	ImpersonatorUsername string
+}
+
+func (p *Principal) Impersonated() bool {
+	return p != nil && p.ImpersonatorID != 0
+}
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+var errSessionRevoked = errors.New("session has been revoked")
+
+// publicRoutes holds the routes registered through Public. Every other route
+// requires authentication.
+var publicRoutes = make(map[*mux.Route]bool)
+
+func Public(route *mux.Route) *mux.Route {
+	publicRoutes[route] = true
+	return route
+}
+
+func PrincipalFromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey).(*Principal)
+	return principal
+}
+
+func currentPrincipal(r *http.Request) *Principal {
+	return PrincipalFromContext(r.Context())
+}
+
+// AuthMiddleware authenticates the bearer token, if any, and stores the
+// principal in the request context. Protected routes are rejected with 401
+// when there is no valid token; public routes are served anonymously.
+func AuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		public := publicRoutes[mux.CurrentRoute(r)]
+
+		authorizationHeader := r.Header.Get("Authorization")
+		if apiKey := r.Header.Get("X-API-Key"); apiKey != "" && authorizationHeader == "" {
+			authorizationHeader = "Bearer " + apiKey
+		}
+		if authorizationHeader == "" {
+			if !public {
+				unauthorized(w, nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, err := authenticateHeader(authorizationHeader)
+		if err != nil {
+			if !public {
+				unauthorized(w, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey, principal)
+		if principal.Impersonated() {
+			serveImpersonated(w, r.WithContext(ctx), next)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticateHeader resolves the principal of an Authorization header. Tests
+// replace it to act as a given role without a database.
+var authenticateHeader = authenticate
+
+func authenticate(authorizationHeader string) (*Principal, error) {
+	scheme, tokenString, found := strings.Cut(authorizationHeader, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return nil, errors.New("unsupported authorization scheme")
+	}
+
+	tokenString = strings.TrimSpace(tokenString)
+	if strings.HasPrefix(tokenString, apiKeyPrefix) {
+		return authenticateAPIKey(tokenString)
+	}
+
+	claims, err := VerifyToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	active, err := models.TouchTokenFamily(claims.FamilyID)
+	if err != nil {
+		log.Println("Error checking token revocation:", err)
+		return nil, errors.New("unable to verify session")
+	}
+	if !active {
+		return nil, errSessionRevoked
+	}
+
+	principal := &Principal{
+		UserID:      claims.UserID,
+		Username:    claims.Username,
+		SessionID:   claims.FamilyID,
+		Role:        claims.Role,
+		Permissions: claims.Permissions,
+	}
+	if claims.Actor != nil {
+		principal.ImpersonatorID = claims.Actor.UserID
+		principal.ImpersonatorUsername = claims.Actor.Username
+	}
+	return principal, nil
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+	challenge := `Bearer realm="shop"`
+	if err != nil {
+		description := strings.ReplaceAll(err.Error(), `"`, `'`)
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description="%s"`, description)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"shop/models"
+	"strings"
+	"time"
+)
+
+const oidcStateTTL = 10 * time.Minute
+
+// oidcStateCookie holds a hash of the state in the browser that started the
+// flow, so a callback can't be completed in someone else's browser.
+const oidcStateCookie = "oidc_state"
+
+// errOIDCEmailMissing is returned for a first-time login from a provider
+// account without an email address; local accounts need a unique one.
+var errOIDCEmailMissing = errors.New("identity provider did not share an email address")
+
+var usernameUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+type OIDCLinkResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+}
+
+func lookupOIDCProvider(w http.ResponseWriter, r *http.Request) *oidcProvider {
+	provider, ok := oidcProviders[mux.Vars(r)["provider"]]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return nil
+	}
+	return provider
+}
+
+// oidcStateCookiePath limits the state cookie to the provider's callback.
+func oidcStateCookiePath(provider *oidcProvider) string {
+	if u, err := url.Parse(provider.config.RedirectURL); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return "/oauth/" + provider.config.Name + "/callback"
+}
+
+// beginOIDCLogin stores a fresh state/nonce/PKCE verifier, binds the state
+// to the browser with a cookie and returns the provider's authorization URL.
+func beginOIDCLogin(w http.ResponseWriter, provider *oidcProvider, linkUserID *int) (string, error) {
+	state, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+	codeVerifier, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	authorizationURL, err := provider.authorizationURL(state, nonce, codeVerifier)
+	if err != nil {
+		return "", err
+	}
+
+	err = models.CreateOIDCState(&models.OIDCState{
+		State:        state,
+		Provider:     provider.config.Name,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    hashToken(state),
+		Path:     oidcStateCookiePath(provider),
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(provider.config.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return authorizationURL, nil
+}
+
+// OIDCStartHandler redirects the browser to the provider to sign in.
+func OIDCStartHandler(w http.ResponseWriter, r *http.Request) {
+	provider := lookupOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	authorizationURL, err := beginOIDCLogin(w, provider, nil)
+	if err != nil {
+		log.Println("Error starting OIDC login:", err)
+		http.Error(w, "Failed to start login", http.StatusBadGateway)
+		return
+	}
+
+	http.Redirect(w, r, authorizationURL, http.StatusFound)
+}
+
+// OIDCLinkHandler starts the same flow for a logged-in user; on callback the
+// external identity is attached to that user instead of logging in. The
+// state cookie is set on this response, so the callback only succeeds in the
+// browser that asked for the link.
+func OIDCLinkHandler(w http.ResponseWriter, r *http.Request) {
+	provider := lookupOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	userID := currentPrincipal(r).UserID
+	authorizationURL, err := beginOIDCLogin(w, provider, &userID)
+	if err != nil {
+		log.Println("Error starting OIDC link:", err)
+		http.Error(w, "Failed to start login", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OIDCLinkResponse{AuthorizationURL: authorizationURL})
+}
+
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	provider := lookupOIDCProvider(w, r)
+	if provider == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		http.Error(w, "Login was not completed: "+errorCode, http.StatusBadRequest)
+		return
+	}
+	if query.Get("state") == "" || query.Get("code") == "" {
+		http.Error(w, "Missing state or code", http.StatusBadRequest)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashToken(query.Get("state")))) != 1 {
+		http.Error(w, "Login was started in a different browser; please start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: oidcStateCookiePath(provider), MaxAge: -1})
+
+	state, err := models.ConsumeOIDCState(query.Get("state"), provider.config.Name)
+	if err != nil {
+		http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		http.Error(w, "Invalid or expired state", http.StatusBadRequest)
+		return
+	}
+
+	rawIDToken, err := provider.exchangeCode(query.Get("code"), state.CodeVerifier)
+	if err != nil {
+		log.Println("Error exchanging OIDC code:", err)
+		http.Error(w, "Failed to complete login", http.StatusBadGateway)
+		return
+	}
+
+	claims, err := provider.verifyIDToken(rawIDToken, state.Nonce)
+	if err != nil {
+		log.Println("Error verifying ID token:", err)
+		http.Error(w, "Invalid ID token", http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := models.GetUserIdentity(provider.config.Name, claims.Subject)
+	if err != nil {
+		http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+		return
+	}
+
+	if state.LinkUserID != nil {
+		linkOIDCIdentity(w, provider, identity, claims, *state.LinkUserID)
+		return
+	}
+
+	var user *models.User
+	if identity != nil {
+		user, err = models.GetUserByID(identity.UserID)
+		if err != nil || user == nil {
+			http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		user, err = createOIDCUser(provider, claims)
+		if errors.Is(err, errOIDCEmailMissing) {
+			http.Error(w, "The identity provider did not share an email address; allow access to it or register with a password", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			log.Println("Error creating user from OIDC login:", err)
+			http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, "An account with this email already exists; log in and link the provider from your profile", http.StatusConflict)
+			return
+		}
+	}
+
+	if accountSuspended(w, user) {
+		auditLogin(r, AuditLoginFailed, "oidc:"+provider.config.Name, user.Username, user, "suspended")
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		mfaToken, err := CreateMFAToken(user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresIn:   int(mfaTokenTTL.Seconds()),
+		})
+		return
+	}
+
+	response, err := startSession(r, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLogin(r, AuditLogin, "oidc:"+provider.config.Name, user.Username, user, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func linkOIDCIdentity(w http.ResponseWriter, provider *oidcProvider, identity *models.UserIdentity, claims *IDTokenClaims, userID int) {
+	if identity != nil {
+		if identity.UserID != userID {
+			http.Error(w, "This external account is already linked to another user", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := models.CreateUserIdentity(&models.UserIdentity{
+		UserID:   userID,
+		Provider: provider.config.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	})
+	if err != nil {
+		http.Error(w, "Failed to link account", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// createOIDCUser registers a local account for a first-time external login.
+// Accounts are never linked by email automatically, since that would let
+// anyone who controls a provider account with a matching address take over
+// the local one; it returns nil, nil when the email is already in use.
+func createOIDCUser(provider *oidcProvider, claims *IDTokenClaims) (*models.User, error) {
+	if claims.Email == "" {
+		return nil, errOIDCEmailMissing
+	}
+	existing, err := models.GetUserByEmail(claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, nil
+	}
+
+	username, err := uniqueUsername(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// External accounts have no usable local password until the user sets one
+	// through the password reset flow.
+	randomPassword, err := generateToken(32)
+	if err != nil {
+		return nil, err
+	}
+	passwordHash, err := HashPassword(randomPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &models.User{
+		Username: username,
+		Password: passwordHash,
+		Email:    claims.Email,
+		Role:     models.RoleCustomer,
+	}
+	identity := &models.UserIdentity{
+		Provider: provider.config.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	err = models.CreateUserWithIdentity(user, identity, claims.EmailVerified)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func uniqueUsername(claims *IDTokenClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(claims.Email, "@")
+	}
+	base = usernameUnsafeChars.ReplaceAllString(base, "")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 24 {
+		base = base[:24]
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		exists, err := models.UsernameExists(candidate)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return candidate, nil
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			return "", err
+		}
+		candidate = fmt.Sprintf("%s_%06d", base, n.Int64())
+	}
+
+	return "", fmt.Errorf("could not find a free username for %q", base)
+}
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// mockIdP is a minimal OpenID provider: discovery, JWKS and a token endpoint
+// that issues an ID token for the last authorization request it was shown.
+type mockIdP struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	code          string
+	codeChallenge string
+	nonce         string
+	claims        jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{t: t, key: key, code: "mock-code"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JWKSet{Keys: []JWK{{
+			KeyType:   "RSA",
+			KeyID:     "mock",
+			Algorithm: "RS256",
+			Use:       "sig",
+			N:         base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("code") != idp.code || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.codeChallenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		claims := jwt.MapClaims{
+			"iss":   idp.server.URL,
+			"aud":   "shop",
+			"sub":   "user-1",
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"nonce": idp.nonce,
+			"email": "user@example.com",
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "mock"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signed})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// authorize plays the browser's visit to the authorization endpoint and
+// returns the query the IdP would redirect back with.
+func (idp *mockIdP) authorize(authorizationURL string) url.Values {
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		idp.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		idp.t.Fatalf("code_challenge_method = %q, want S256", query.Get("code_challenge_method"))
+	}
+	idp.codeChallenge = query.Get("code_challenge")
+	idp.nonce = query.Get("nonce")
+	return url.Values{"code": {idp.code}, "state": {query.Get("state")}}
+}
+
+func (idp *mockIdP) provider() *oidcProvider {
+	return &oidcProvider{config: OIDCProviderConfig{
+		Name:        "mock",
+		Issuer:      idp.server.URL,
+		ClientID:    "shop",
+		RedirectURL: "http://localhost:8080/oauth/mock/callback",
+	}}
+}
+
+func TestOIDCCodeFlowAgainstMockIdP(t *testing.T) {
+	idp := newMockIdP(t)
+	provider := idp.provider()
+
+	authorizationURL, err := provider.authorizationURL("state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := idp.authorize(authorizationURL)
+	if callback.Get("state") != "state-1" {
+		t.Fatalf("state = %q, want state-1", callback.Get("state"))
+	}
+
+	rawIDToken, err := provider.exchangeCode(callback.Get("code"), "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := provider.verifyIDToken(rawIDToken, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user-1" || claims.Email != "user@example.com" {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	if _, err := provider.verifyIDToken(rawIDToken, "other-nonce"); err == nil {
+		t.Error("ID token accepted with the wrong nonce")
+	}
+	if _, err := provider.exchangeCode(callback.Get("code"), "wrong-verifier"); err == nil {
+		t.Error("code redeemed with the wrong PKCE verifier")
+	}
+}
+
+func TestOIDCRejectsForeignAudience(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = jwt.MapClaims{"aud": "another-client"}
+	provider := idp.provider()
+
+	authorizationURL, err := provider.authorizationURL("state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawIDToken, err := provider.exchangeCode(idp.authorize(authorizationURL).Get("code"), "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.verifyIDToken(rawIDToken, "nonce-1"); err == nil {
+		t.Error("ID token for another client accepted")
+	}
+}
+
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	idp := newMockIdP(t)
+	oidcProviders["mock"] = idp.provider()
+	t.Cleanup(func() { delete(oidcProviders, "mock") })
+
+	for name, cookie := range map[string]*http.Cookie{
+		"no cookie":    nil,
+		"other state":  {Name: oidcStateCookie, Value: hashToken("attacker-state")},
+		"plain state":  {Name: oidcStateCookie, Value: "state-1"},
+		"empty cookie": {Name: oidcStateCookie, Value: ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/oauth/mock/callback?state=state-1&code=mock-code", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		r = mux.SetURLVars(r, map[string]string{"provider": "mock"})
+		w := httptest.NewRecorder()
+
+		OIDCCallbackHandler(w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
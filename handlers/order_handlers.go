@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
@@ -9,20 +10,126 @@ import (
 	"strconv"
 )
 
-func GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+// OrderItemRequest is one line of an order. variant_id is required for
+// products that have variants.
+type OrderItemRequest struct {
+	ProductID int  `json:"product_id" validate:"required,gt=0"`
+	VariantID *int `json:"variant_id" validate:"omitempty,gt=0"`
+	// Quantity defaults to 1.
+	Quantity int `json:"quantity" validate:"omitempty,min=1,max=1000"`
+}
+
+type CreateOrderRequest struct {
+	// ProductIDs orders one of each product; Items also takes variants and
+	// quantities. At least one of them must be given.
+	ProductIDs []int              `json:"product_ids" validate:"max=100"`
+	Items      []OrderItemRequest `json:"items" validate:"max=100"`
+	// Address IDs are optional and default to the user's default shipping
+	// and billing addresses.
+	ShippingAddressID *int `json:"shipping_address_id" validate:"omitempty,gt=0"`
+	BillingAddressID  *int `json:"billing_address_id" validate:"omitempty,gt=0"`
+}
+
+func (req *CreateOrderRequest) Normalize() {
+	for i := range req.Items {
+		if req.Items[i].Quantity == 0 {
+			req.Items[i].Quantity = 1
+		}
+	}
+}
+
+func (req *CreateOrderRequest) Validate() []FieldError {
+	if len(req.ProductIDs) == 0 && len(req.Items) == 0 {
+		return []FieldError{{Field: "items", Rule: "required", Message: "is required"}}
+	}
+	if len(req.ProductIDs) <= 100 && len(req.Items) <= 100 && len(req.ProductIDs)+len(req.Items) > 100 {
+		return []FieldError{{Field: "items", Rule: "max", Message: "must have at most 100 elements in total with product_ids"}}
+	}
+	return nil
+}
+
+// orderLine is an order item resolved against the catalog.
+type orderLine struct {
+	field    string
+	product  *models.Product
+	variant  *models.ProductVariant
+	quantity int
+}
+
+func (l orderLine) unitPrice() float64 {
+	if l.variant != nil {
+		return l.variant.UnitPrice(l.product)
+	}
+	return l.product.Price
+}
+
+// resolveOrderLine loads the product and variant of one order line. field
+// is the request path of the line for error messages; the returned error
+// list is empty on success.
+func resolveOrderLine(field string, productID int, variantID *int, quantity int) (orderLine, []FieldError, error) {
+	line := orderLine{field: field, quantity: quantity}
+
+	product, err := models.GetProductByID(productID)
+	if err != nil {
+		return line, nil, err
+	}
+	if product == nil {
+		return line, []FieldError{{Field: field, Rule: "exists", Message: "product not found"}}, nil
+	}
+	line.product = product
+
+	if variantID == nil {
+		variants, err := models.GetProductVariants([]int{productID})
+		if err != nil {
+			return line, nil, err
+		}
+		if len(variants[productID]) > 0 {
+			return line, []FieldError{{Field: field, Rule: "variant", Message: "product has variants; order it through items with a variant_id"}}, nil
+		}
+		return line, nil, nil
+	}
+
+	variant, err := models.GetProductVariant(productID, *variantID)
+	if err != nil {
+		return line, nil, err
+	}
+	if variant == nil {
+		return line, []FieldError{{Field: field + ".variant_id", Rule: "exists", Message: "variant not found for this product"}}, nil
+	}
+	line.variant = variant
+	return line, nil, nil
+}
+
+type UpdateOrderRequest struct {
+	Status string `json:"status" validate:"required,oneof=created paid shipped delivered cancelled"`
+}
+
+// newestOrdersFirst is the default order of order listings.
+var newestOrdersFirst = []models.SortKey{{Field: "created_at", Desc: true}}
+
+// writeOrderList serves the orders of one user with the client's filter_by,
+// sort_by and pagination parameters.
+func writeOrderList(w http.ResponseWriter, r *http.Request, userID int) {
+	filter, page, ok := listQueryFromRequest(w, r, newestOrdersFirst)
+	if !ok {
 		return
 	}
+	filter = append(filter, models.FilterCondition{Field: "user_id", Operator: "=", Value: strconv.Itoa(userID)})
 
-	orders, err := models.GetOrdersByUserID(currentUser.ID)
+	orders, info, err := models.GetOrders(filter, page)
 	if err != nil {
+		if writeQueryError(w, err) {
+			return
+		}
 		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(orders)
+	writeList(w, r, orders, info)
+}
+
+func GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	writeOrderList(w, r, currentPrincipal(r).UserID)
 }
 func GetIDOrderHandler(w http.ResponseWriter, r *http.Request) {
 	orderIDStr := mux.Vars(r)["order_id"]
@@ -42,65 +149,108 @@ func GetIDOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !canViewOrder(currentPrincipal(r), order) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	json.NewEncoder(w).Encode(order)
 }
 
 func CreateOrderHandler(w http.ResponseWriter, r *http.Request) {
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	principal := currentPrincipal(r)
+
+	user, err := models.GetUserByID(principal.UserID)
+	if err != nil {
+		http.Error(w, "Failed to get user profile", http.StatusInternalServerError)
+		return
+	}
+	if user == nil || user.EmailVerifiedAt == nil {
+		http.Error(w, "Email address must be verified before checkout", http.StatusForbidden)
 		return
 	}
 
-	var orderRequest struct {
-		ProductIDs []int `json:"product_ids"`
+	var orderRequest CreateOrderRequest
+	if !decodeJSON(w, r, &orderRequest) {
+		return
 	}
-	err := json.NewDecoder(r.Body).Decode(&orderRequest)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+
+	shippingAddress, billingAddress, ok := resolveOrderAddresses(w, principal.UserID, orderRequest.ShippingAddressID, orderRequest.BillingAddressID)
+	if !ok {
 		return
 	}
 
-	var products []*models.Product
-	for _, productID := range orderRequest.ProductIDs {
-		product, err := models.GetProductByID(productID)
+	var lines []orderLine
+	var errs []FieldError
+	for i, productID := range orderRequest.ProductIDs {
+		line, lineErrs, err := resolveOrderLine(fmt.Sprintf("product_ids[%d]", i), productID, nil, 1)
 		if err != nil {
 			http.Error(w, "Failed to get product information", http.StatusInternalServerError)
 			return
 		}
-		products = append(products, product)
+		errs = append(errs, lineErrs...)
+		lines = append(lines, line)
 	}
-
-	var totalAmount float64
-	for _, product := range products {
-		totalAmount += product.Price
+	for i, item := range orderRequest.Items {
+		line, lineErrs, err := resolveOrderLine(fmt.Sprintf("items[%d]", i), item.ProductID, item.VariantID, item.Quantity)
+		if err != nil {
+			http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+			return
+		}
+		errs = append(errs, lineErrs...)
+		lines = append(lines, line)
 	}
-
-	order := &models.Order{
-		UserID:      currentUser.ID,
-		TotalAmount: totalAmount,
-		Status:      "created",
+	// Lines for the same variant draw on the same stock.
+	ordered := make(map[int]int)
+	for _, line := range lines {
+		if line.variant == nil {
+			continue
+		}
+		ordered[line.variant.ID] += line.quantity
+		if ordered[line.variant.ID] > line.variant.StockQuantity {
+			errs = append(errs, FieldError{Field: line.field + ".quantity", Rule: "stock", Message: fmt.Sprintf("only %d of %s in stock", line.variant.StockQuantity, line.variant.SKU)})
+		}
 	}
-	err = models.CreateOrder(order)
-	if err != nil {
-		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+	if len(errs) > 0 {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", errs)
 		return
 	}
 
-	orderID := order.ID
+	var totalAmount float64
+	for _, line := range lines {
+		totalAmount += line.unitPrice() * float64(line.quantity)
+	}
 
-	for _, product := range products {
+	order := &models.Order{
+		UserID:          principal.UserID,
+		TotalAmount:     totalAmount,
+		Status:          "created",
+		ShippingAddress: shippingAddress,
+		BillingAddress:  billingAddress,
+	}
+	var items []*models.OrderItem
+	for _, line := range lines {
 		orderItem := &models.OrderItem{
-			OrderID:   orderID,
-			ProductID: product.ID,
-			Quantity:  1,
-			Price:     product.Price,
+			ProductID: line.product.ID,
+			Quantity:  line.quantity,
+			Price:     line.unitPrice(),
 		}
-		err = models.CreateOrderItem(orderItem)
-		if err != nil {
-			http.Error(w, "Failed to add product to order", http.StatusInternalServerError)
+		if line.variant != nil {
+			orderItem.VariantID = &line.variant.ID
+			orderItem.SKU = line.variant.SKU
+		}
+		items = append(items, orderItem)
+	}
+
+	err = models.PlaceOrder(order, items)
+	if err != nil {
+		var stockErr *models.OutOfStockError
+		if errors.As(err, &stockErr) {
+			http.Error(w, "Not enough stock left for one of the variants; please review your order", http.StatusConflict)
 			return
 		}
+		http.Error(w, "Failed to create order", http.StatusInternalServerError)
+		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
@@ -115,38 +265,52 @@ func UpdateOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var updateRequest struct {
-		Status string `json:"status"`
-	}
-	err = json.NewDecoder(r.Body).Decode(&updateRequest)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
-
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	var updateRequest UpdateOrderRequest
+	if !decodeJSON(w, r, &updateRequest) {
 		return
 	}
 
 	order, err := models.GetOrderByID(orderID)
 	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+	if order == nil {
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
 
-	if currentUser.ID != order.UserID {
+	if !canSetOrderStatus(currentPrincipal(r), order, updateRequest.Status) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
+	previousStatus := order.Status
 	order.Status = updateRequest.Status
-	err = models.UpdateOrder(order)
+	updated, err := models.SetOrderStatus(order, previousStatus)
 	if err != nil {
+		var stockErr *models.OutOfStockError
+		if errors.As(err, &stockErr) {
+			http.Error(w, "Not enough stock left to reopen the order", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Failed to update order", http.StatusInternalServerError)
 		return
 	}
+	if !updated {
+		http.Error(w, "The order status has changed; please reload the order", http.StatusConflict)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditOrderStatusChange,
+		TargetType: "order",
+		TargetID:   strconv.Itoa(order.ID),
+		Changes: auditChanges(
+			map[string]interface{}{"status": previousStatus},
+			map[string]interface{}{"status": order.Status},
+		),
+	})
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -159,28 +323,32 @@ func DeleteOrderHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
 	order, err := models.GetOrderByID(orderID)
 	if err != nil {
-		http.Error(w, "Order not found", http.StatusNotFound)
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
 		return
 	}
-
-	if currentUser.ID != order.UserID {
-		http.Error(w, "Forbidden: You are not allowed to delete this order", http.StatusForbidden)
+	if order == nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
 
-	err = models.DeleteOrder(orderID)
+	deleted, err := models.DeleteOrder(orderID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to delete order: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if !deleted {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditOrderDelete,
+		TargetType: "order",
+		TargetID:   strconv.Itoa(orderID),
+		Details:    map[string]interface{}{"user_id": order.UserID, "status": order.Status, "total_amount": order.TotalAmount},
+	})
 
 	w.WriteHeader(http.StatusOK)
 }
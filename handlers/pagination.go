@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"shop/models"
+	"strconv"
+	"strings"
+)
+
+// ListResponse is the envelope of every paginated list. Pass next_cursor
+// back as cursor to get the following page; it is absent on the last page.
+// total is only counted when include_total=true is asked for.
+type ListResponse struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Total      *int        `json:"total,omitempty"`
+}
+
+// queryErrorParams maps the clauses of a models.QueryError to the query
+// parameters they came from.
+var queryErrorParams = map[string]string{
+	"filter": "filter_by",
+	"sort":   "sort_by",
+	"cursor": "cursor",
+}
+
+// writeQueryError answers 400 for a bad filter, sort or cursor and reports
+// whether err was one.
+func writeQueryError(w http.ResponseWriter, err error) bool {
+	var queryErr *models.QueryError
+	if !errors.As(err, &queryErr) {
+		return false
+	}
+	writeValidationErrors(w, http.StatusBadRequest, "Invalid query", []FieldError{
+		{Field: queryErrorParams[queryErr.Clause], Rule: queryErr.Rule, Message: queryErr.Message},
+	})
+	return true
+}
+
+// pageRequestFromQuery reads limit, cursor and include_total. The sort
+// order is up to the caller.
+func pageRequestFromQuery(w http.ResponseWriter, r *http.Request) (models.PageRequest, bool) {
+	query := r.URL.Query()
+	page := models.PageRequest{
+		Cursor: query.Get("cursor"),
+		Limit:  models.DefaultPageSize,
+	}
+
+	var errs []FieldError
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > models.MaxPageSize {
+			errs = append(errs, FieldError{Field: "limit", Rule: "range", Message: "must be an integer from 1 to " + strconv.Itoa(models.MaxPageSize)})
+		}
+		page.Limit = limit
+	}
+	if v := query.Get("include_total"); v != "" {
+		withTotal, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "include_total", Rule: "type", Message: "must be true or false"})
+		}
+		page.WithTotal = withTotal
+	}
+
+	if len(errs) > 0 {
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid query", errs)
+		return page, false
+	}
+	return page, true
+}
+
+// listQueryFromRequest reads the pagination parameters plus the filter_by
+// and sort_by expressions. defaultSort applies when sort_by is absent.
+func listQueryFromRequest(w http.ResponseWriter, r *http.Request, defaultSort []models.SortKey) ([]models.FilterCondition, models.PageRequest, bool) {
+	page, ok := pageRequestFromQuery(w, r)
+	if !ok {
+		return nil, page, false
+	}
+
+	filter, err := models.ParseFilter(r.URL.Query().Get("filter_by"))
+	if err != nil {
+		writeQueryError(w, err)
+		return nil, page, false
+	}
+	sort, err := models.ParseSort(r.URL.Query().Get("sort_by"))
+	if err != nil {
+		writeQueryError(w, err)
+		return nil, page, false
+	}
+	if sort == nil {
+		sort = defaultSort
+	}
+	page.Sort = sort
+
+	return filter, page, true
+}
+
+// pageLink is the request URL with the cursor replaced, as an RFC 8288
+// link. The reference is relative so it stays right behind proxies.
+func pageLink(r *http.Request, cursor, rel string) string {
+	u := *r.URL
+	query := u.Query()
+	query.Del("cursor")
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+	u.RawQuery = query.Encode()
+	return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+}
+
+// writeList writes one page in the ListResponse envelope, with Link headers
+// to the first and the next page.
+func writeList(w http.ResponseWriter, r *http.Request, items interface{}, info models.PageInfo) {
+	if v := reflect.ValueOf(items); v.Kind() == reflect.Slice && v.IsNil() {
+		items = []struct{}{}
+	}
+
+	links := []string{pageLink(r, "", "first")}
+	if info.NextCursor != "" {
+		links = append(links, pageLink(r, info.NextCursor, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListResponse{
+		Items:      items,
+		NextCursor: info.NextCursor,
+		Total:      info.Total,
+	})
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"strings"
+)
+
+// Hashes are stored in the PHC string format so the algorithm and its
+// parameters travel with every row:
+//
+//	$argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+//
+// Rows that don't start with a known prefix are legacy plaintext passwords
+// and get rehashed on the next successful login.
+const argon2idPrefix = "$argon2id$"
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	saltLen uint32
+	keyLen  uint32
+}
+
+var currentArgon2Params = argon2Params{
+	memory:  64 * 1024,
+	time:    3,
+	threads: 2,
+	saltLen: 16,
+	keyLen:  32,
+}
+
+var errInvalidHash = errors.New("invalid password hash format")
+
+// dummyHash is verified against when the user doesn't exist, so that a
+// missing account takes as long to reject as a wrong password.
+var dummyHash, _ = HashPassword("dummy password used for timing equalization")
+
+func HashPassword(password string) (string, error) {
+	p := currentArgon2Params
+	salt := make([]byte, p.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, p.keyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// CheckPassword reports whether password matches the stored value and
+// whether the stored value should be replaced with a fresh hash (legacy
+// plaintext row or outdated parameters).
+func CheckPassword(stored, password string) (match bool, needsRehash bool) {
+	if !strings.HasPrefix(stored, argon2idPrefix) {
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+
+	p, salt, key, err := decodeArgon2Hash(stored)
+	if err != nil {
+		return false, false
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, candidate) != 1 {
+		return false, false
+	}
+
+	c := currentArgon2Params
+	needsRehash = p.memory != c.memory || p.time != c.time || p.threads != c.threads ||
+		uint32(len(salt)) != c.saltLen || uint32(len(key)) != c.keyLen
+	return true, needsRehash
+}
+
+func decodeArgon2Hash(encoded string) (argon2Params, []byte, []byte, error) {
+	var p argon2Params
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	if version != argon2.Version {
+		return p, nil, nil, errInvalidHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, errInvalidHash
+	}
+	p.saltLen = uint32(len(salt))
+	p.keyLen = uint32(len(key))
+
+	return p, salt, key, nil
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"shop/mailer"
+	"shop/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const passwordResetTTL = time.Hour
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email,max=254"`
+}
+
+func (req *ForgotPasswordRequest) Normalize() {
+	req.Email = strings.TrimSpace(req.Email)
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required,min=8,max=128"`
+}
+
+// passwordResetPage is where the link in the reset email lands. It posts the
+// token from the link together with the new password to POST
+// /password/reset.
+var passwordResetPage = template.Must(template.New("password_reset").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Reset password</title>
+</head>
+<body>
+<h1>Reset password</h1>
+<form id="reset-form">
+    <input type="hidden" id="token" value="{{.}}">
+    <label for="new_password">New password:</label><br>
+    <input type="password" id="new_password" minlength="8" maxlength="128" required><br><br>
+    <input type="submit" value="Reset password">
+</form>
+<div id="message"></div>
+<script>
+document.getElementById('reset-form').addEventListener('submit', function(event) {
+    event.preventDefault();
+    fetch('/password/reset', {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({
+            token: document.getElementById('token').value,
+            new_password: document.getElementById('new_password').value
+        })
+    }).then(function(response) {
+        if (response.ok) {
+            document.getElementById('message').textContent = 'Your password has been reset. You can log in now.';
+            document.getElementById('reset-form').hidden = true;
+            return;
+        }
+        return response.text().then(function(text) {
+            document.getElementById('message').textContent = text;
+        });
+    });
+});
+</script>
+</body>
+</html>
+`))
+
+// passwordResetEmail issues a reset token for the user and returns the email
+// carrying its link.
+func passwordResetEmail(user *models.User) (mailer.Message, error) {
+	plain, err := generateToken(32)
+	if err != nil {
+		return mailer.Message{}, err
+	}
+
+	err = models.CreatePasswordResetToken(&models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashToken(plain),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	})
+	if err != nil {
+		return mailer.Message{}, err
+	}
+
+	link := fmt.Sprintf("%s/password/reset?token=%s", appBaseURL(), url.QueryEscape(plain))
+	return mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open the link below:\n\n%s\n\nThe link expires in %d minutes and can be used once. If you didn't ask for this, you can ignore this email.\n",
+			user.Username, link, int(passwordResetTTL.Minutes())),
+	}, nil
+}
+
+func sendPasswordResetEmail(user *models.User) error {
+	message, err := passwordResetEmail(user)
+	if err != nil {
+		return err
+	}
+	return mailSender.Send(message)
+}
+
+// ForgotPasswordHandler always answers 202 so the response doesn't reveal
+// whether an account exists. The token is stored before answering; only
+// sending the email happens in the background.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	user, err := models.GetUserByEmail(req.Email)
+	if err != nil {
+		log.Println("Error looking up user for password reset:", err)
+	}
+	if user != nil {
+		message, err := passwordResetEmail(user)
+		if err != nil {
+			log.Println("Error creating password reset token:", err)
+		} else {
+			go func() {
+				if err := mailSender.Send(message); err != nil {
+					log.Println("Error sending password reset email:", err)
+				}
+			}()
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPasswordPageHandler serves the form the reset email links to. The
+// token is only checked when the form is submitted.
+func ResetPasswordPageHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing token", http.StatusBadRequest)
+		return
+	}
+
+	// The token is in the URL; keep it out of caches and Referer headers.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := passwordResetPage.Execute(w, token); err != nil {
+		log.Println("Error rendering password reset page:", err)
+	}
+}
+
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	passwordHash, err := HashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := models.ResetPassword(hashToken(req.Token), passwordHash)
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	if userID == 0 {
+		http.Error(w, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditPasswordReset, TargetType: "user", TargetID: strconv.Itoa(userID)})
+	w.WriteHeader(http.StatusNoContent)
+}
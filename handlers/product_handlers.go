@@ -7,45 +7,124 @@ import (
 	"net/http"
 	"shop/models"
 	"strconv"
+	"strings"
 )
 
 type ProductRequest struct {
-	Name          string  `json:"name"`
-	Description   string  `json:"description"`
-	Price         float64 `json:"price"`
-	StockQuantity int     `json:"stock_quantity"`
+	Name          string  `json:"name" validate:"required,max=200"`
+	Description   string  `json:"description" validate:"max=5000"`
+	Price         float64 `json:"price" validate:"gt=0,max=1000000"`
+	StockQuantity int     `json:"stock_quantity" validate:"min=0,max=1000000"`
 }
 
-func GetAllProducts(w http.ResponseWriter, r *http.Request) {
-	sortBy := r.URL.Query().Get("sort_by")
-	pageNumberStr := r.URL.Query().Get("page")
-	pageSizeStr := r.URL.Query().Get("page_size")
-	filterBy := r.URL.Query().Get("filter_by")
+func (req *ProductRequest) Normalize() {
+	req.Name = strings.TrimSpace(req.Name)
+	req.Description = strings.TrimSpace(req.Description)
+}
 
-	pageNumber, err := strconv.Atoi(pageNumberStr)
-	if err != nil || pageNumber < 1 {
-		pageNumber = 1
+// attachProductDetails fills in the category paths, options and variants of
+// the products.
+func attachProductDetails(products []*models.Product) error {
+	if len(products) == 0 {
+		return nil
 	}
-	pageSize, err := strconv.Atoi(pageSizeStr)
-	if err != nil || pageSize < 1 {
-		pageSize = 10
+	ids := make([]int, len(products))
+	for i, product := range products {
+		ids[i] = product.ID
 	}
 
-	products, err := models.GetProducts(pageNumber, pageSize, sortBy, filterBy)
+	breadcrumbs, err := models.GetProductBreadcrumbs(ids)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	options, err := models.GetProductOptions(ids)
+	if err != nil {
+		return err
+	}
+	variants, err := models.GetProductVariants(ids)
+	if err != nil {
+		return err
+	}
+	for _, product := range products {
+		product.Breadcrumbs = breadcrumbs[product.ID]
+		product.Options = options[product.ID]
+		product.Variants = variants[product.ID]
+	}
+	return nil
+}
+
+// ownerFilter restricts a product listing to one owner on top of the
+// client's filter.
+func ownerFilter(filter []models.FilterCondition, ownerID int) []models.FilterCondition {
+	return append(filter, models.FilterCondition{Field: "owner_id", Operator: "=", Value: strconv.Itoa(ownerID)})
+}
+
+// writeProductList serves a product listing with the client's filter_by,
+// sort_by and pagination parameters; extra narrows the filter further.
+func writeProductList(w http.ResponseWriter, r *http.Request, extra func([]models.FilterCondition) []models.FilterCondition) {
+	filter, page, ok := listQueryFromRequest(w, r, nil)
+	if !ok {
 		return
 	}
+	if extra != nil {
+		filter = extra(filter)
+	}
 
-	jsonResponse, err := json.Marshal(products)
+	products, info, err := models.GetProducts(filter, page)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if writeQueryError(w, err) {
+			return
+		}
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
+		return
+	}
+	if err := attachProductDetails(products); err != nil {
+		http.Error(w, "Failed to fetch products", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(jsonResponse)
+	writeList(w, r, products, info)
+}
+
+func GetAllProducts(w http.ResponseWriter, r *http.Request) {
+	writeProductList(w, r, nil)
+}
+
+// SearchProducts runs a full-text search over product names and
+// descriptions. Words match by prefix and stem, and name matches rank
+// higher.
+func SearchProducts(w http.ResponseWriter, r *http.Request) {
+	tsquery := models.SearchQuery(r.URL.Query().Get("q"))
+	if tsquery == "" {
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid query", []FieldError{
+			{Field: "q", Rule: "required", Message: "must contain at least one word"},
+		})
+		return
+	}
+
+	page, ok := pageRequestFromQuery(w, r)
+	if !ok {
+		return
+	}
+
+	results, info, err := models.SearchProducts(tsquery, page)
+	if err != nil {
+		if writeQueryError(w, err) {
+			return
+		}
+		http.Error(w, "Failed to search products", http.StatusInternalServerError)
+		return
+	}
+	products := make([]*models.Product, len(results))
+	for i, result := range results {
+		products[i] = result.Product
+	}
+	if err := attachProductDetails(products); err != nil {
+		http.Error(w, "Failed to search products", http.StatusInternalServerError)
+		return
+	}
+
+	writeList(w, r, results, info)
 }
 
 func GetProductByID(w http.ResponseWriter, r *http.Request) {
@@ -67,38 +146,44 @@ func GetProductByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := attachProductDetails([]*models.Product{product}); err != nil {
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(product)
 }
 
 func AddProduct(w http.ResponseWriter, r *http.Request) {
 	var productReq ProductRequest
-	err := json.NewDecoder(r.Body).Decode(&productReq)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !decodeJSON(w, r, &productReq) {
 		return
 	}
 
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
+	principal := currentPrincipal(r)
 
 	newProduct := &models.Product{
 		Name:          productReq.Name,
 		Description:   productReq.Description,
 		Price:         productReq.Price,
 		StockQuantity: productReq.StockQuantity,
-		OwnerID:       currentUser.ID,
+		OwnerID:       principal.UserID,
 	}
 
-	err = models.CreateProduct(newProduct)
+	err := models.CreateProduct(newProduct)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductCreate,
+		TargetType: "product",
+		TargetID:   strconv.Itoa(newProduct.ID),
+		Changes:    auditChanges(nil, productAuditFields(newProduct)),
+	})
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(newProduct)
 }
@@ -115,36 +200,44 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request) {
 
 	product, err := models.GetProductByID(productID)
 	if err != nil {
-		http.Error(w, "Product not found", http.StatusNotFound)
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
 		return
 	}
-
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if product == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
 
-	if product.OwnerID != currentUser.ID {
-		http.Error(w, "You are not authorized to update this product", http.StatusUnauthorized)
+	if !canManageProduct(currentPrincipal(r), product) {
+		http.Error(w, "You are not authorized to update this product", http.StatusForbidden)
 		return
 	}
 
-	var updatedProduct models.Product
-	err = json.NewDecoder(r.Body).Decode(&updatedProduct)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var productReq ProductRequest
+	if !decodeJSON(w, r, &productReq) {
 		return
 	}
 
+	updatedProduct := models.Product{
+		Name:          productReq.Name,
+		Description:   productReq.Description,
+		Price:         productReq.Price,
+		StockQuantity: productReq.StockQuantity,
+	}
 	err = models.UpdateProduct(productID, &updatedProduct)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductUpdate,
+		TargetType: "product",
+		TargetID:   strconv.Itoa(productID),
+		Changes:    auditChanges(productAuditFields(product), productAuditFields(&updatedProduct)),
+	})
+
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Product updated successfully"))
 }
 
 func DeleteProduct(w http.ResponseWriter, r *http.Request) {
@@ -157,17 +250,15 @@ func DeleteProduct(w http.ResponseWriter, r *http.Request) {
 
 	product, err := models.GetProductByID(productID)
 	if err != nil {
-		http.Error(w, "Product not found", http.StatusNotFound)
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
 		return
 	}
-
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if product == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
 		return
 	}
 
-	if currentUser.ID != product.OwnerID {
+	if !canManageProduct(currentPrincipal(r), product) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -179,22 +270,20 @@ func DeleteProduct(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductDelete,
+		TargetType: "product",
+		TargetID:   strconv.Itoa(productID),
+		Details:    map[string]interface{}{"owner_id": product.OwnerID},
+		Changes:    auditChanges(productAuditFields(product), nil),
+	})
+
 	// Возвращаем успешный статус
 	w.WriteHeader(http.StatusOK)
 }
 func GetMyProducts(w http.ResponseWriter, r *http.Request) {
-	currentUser := getCurrentUser(r)
-	if currentUser == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
-	products, err := models.GetProductsByOwnerID(currentUser.ID)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to retrieve products: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(products)
+	ownerID := currentPrincipal(r).UserID
+	writeProductList(w, r, func(filter []models.FilterCondition) []models.FilterCondition {
+		return ownerFilter(filter, ownerID)
+	})
 }
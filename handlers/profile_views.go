@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"shop/models"
+	"time"
+)
+
+// User rows are never encoded directly. Handlers go through profileView,
+// which picks the representation the viewer is allowed to see.
+
+// PublicProfile is what anyone may see about a user.
+type PublicProfile struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// PrivateProfile adds contact and account details, visible only to the user
+// themselves and to administrators.
+type PrivateProfile struct {
+	PublicProfile
+	Email            string     `json:"email"`
+	EmailVerified    bool       `json:"email_verified"`
+	Role             string     `json:"role"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	EmailVerifiedAt  *time.Time `json:"email_verified_at,omitempty"`
+	// ErasureScheduledAt is set while a requested account deletion can
+	// still be cancelled.
+	ErasureScheduledAt *time.Time `json:"erasure_scheduled_at,omitempty"`
+}
+
+func canViewPrivateProfile(viewer *Principal, user *models.User) bool {
+	if viewer == nil {
+		return false
+	}
+	return viewer.UserID == user.ID || viewer.Can(PermUsersManage)
+}
+
+func publicProfile(user *models.User) PublicProfile {
+	return PublicProfile{ID: user.ID, Username: user.Username}
+}
+
+func privateProfile(user *models.User) PrivateProfile {
+	return PrivateProfile{
+		PublicProfile:      publicProfile(user),
+		Email:              user.Email,
+		EmailVerified:      user.EmailVerifiedAt != nil,
+		Role:               user.Role,
+		TwoFactorEnabled:   user.TOTPEnabledAt != nil,
+		EmailVerifiedAt:    user.EmailVerifiedAt,
+		ErasureScheduledAt: user.ErasureScheduledAt,
+	}
+}
+
+func profileView(user *models.User, viewer *Principal) interface{} {
+	if canViewPrivateProfile(viewer, user) {
+		return privateProfile(user)
+	}
+	return publicProfile(user)
+}
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+)
+
+// route is one entry of the API. Public routes are open; every other route
+// requires a token and, when permission is set, that permission.
+// sessionOnly routes refuse API keys, and only impersonable routes can be
+// reached with an impersonation token.
+type route struct {
+	method       string
+	path         string
+	handler      http.HandlerFunc
+	public       bool
+	permission   string
+	sessionOnly  bool
+	impersonable bool
+}
+
+var routes = []route{
+	{method: "GET", path: "/.well-known/jwks.json", handler: JWKSHandler, public: true},
+	{method: "POST", path: "/register", handler: RegisterHandler, public: true},
+	{method: "POST", path: "/login", handler: LoginHandler, public: true},
+	{method: "POST", path: "/login/mfa", handler: LoginMFAHandler, public: true},
+	{method: "GET", path: "/oauth/{provider}/start", handler: OIDCStartHandler, public: true},
+	{method: "GET", path: "/oauth/{provider}/callback", handler: OIDCCallbackHandler, public: true},
+	{method: "POST", path: "/oauth/{provider}/link", handler: OIDCLinkHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "POST", path: "/token/refresh", handler: RefreshTokenHandler, public: true},
+	{method: "POST", path: "/logout", handler: LogoutHandler},
+	{method: "GET", path: "/verify-email", handler: VerifyEmailHandler, public: true},
+	{method: "POST", path: "/verify-email", handler: VerifyEmailHandler, public: true},
+	{method: "POST", path: "/password/forgot", handler: ForgotPasswordHandler, public: true},
+	{method: "GET", path: "/password/reset", handler: ResetPasswordPageHandler, public: true},
+	{method: "POST", path: "/password/reset", handler: ResetPasswordHandler, public: true},
+	{method: "POST", path: "/verify-email/resend", handler: ResendVerificationHandler, permission: PermProfileWrite},
+	{method: "POST", path: "/2fa/enroll", handler: EnrollTOTPHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "POST", path: "/2fa/confirm", handler: ConfirmTOTPHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "POST", path: "/2fa/disable", handler: DisableTOTPHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "GET", path: "/sessions", handler: GetSessionsHandler, permission: PermProfileRead, sessionOnly: true},
+	{method: "DELETE", path: "/sessions", handler: RevokeOtherSessionsHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "DELETE", path: "/sessions/{id}", handler: RevokeSessionHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "GET", path: "/apikeys", handler: GetAPIKeysHandler, permission: PermProfileRead, sessionOnly: true},
+	{method: "POST", path: "/apikeys", handler: CreateAPIKeyHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "DELETE", path: "/apikeys/{id}", handler: RevokeAPIKeyHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "GET", path: "/profile", handler: GetProfileHandler, permission: PermProfileRead, impersonable: true},
+	{method: "PATCH", path: "/profile", handler: UpdateProfileHandler, permission: PermProfileWrite},
+	{method: "PUT", path: "/profile/update", handler: UpdateProfileHandler, permission: PermProfileWrite},
+	{method: "POST", path: "/profile/password", handler: ChangePasswordHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "DELETE", path: "/profile", handler: DeleteProfileHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "DELETE", path: "/profile/delete", handler: DeleteProfileHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "POST", path: "/profile/delete/cancel", handler: CancelErasureHandler, permission: PermProfileWrite, sessionOnly: true},
+	{method: "GET", path: "/profile/export", handler: ExportDataHandler, permission: PermProfileRead},
+	{method: "GET", path: "/addresses", handler: GetAddressesHandler, permission: PermProfileRead},
+	{method: "POST", path: "/addresses", handler: CreateAddressHandler, permission: PermProfileWrite},
+	{method: "GET", path: "/addresses/{id}", handler: GetAddressHandler, permission: PermProfileRead},
+	{method: "PUT", path: "/addresses/{id}", handler: UpdateAddressHandler, permission: PermProfileWrite},
+	{method: "DELETE", path: "/addresses/{id}", handler: DeleteAddressHandler, permission: PermProfileWrite},
+	{method: "GET", path: "/profile/{username}", handler: GetUserProfileHandler, public: true, impersonable: true},
+	{method: "GET", path: "/products", handler: GetAllProducts, public: true, impersonable: true},
+	{method: "GET", path: "/products/search", handler: SearchProducts, public: true, impersonable: true},
+	{method: "GET", path: "/products/{id}", handler: GetProductByID, public: true, impersonable: true},
+	{method: "POST", path: "/products/add", handler: AddProduct, permission: PermProductsWrite},
+	{method: "PUT", path: "/products/{id}/update", handler: UpdateProduct, permission: PermProductsWrite},
+	{method: "DELETE", path: "/products/{id}/delete", handler: DeleteProduct, permission: PermProductsWrite},
+	{method: "PUT", path: "/products/{id}/categories", handler: SetProductCategoriesHandler, permission: PermProductsWrite},
+	{method: "GET", path: "/products/{id}/variants", handler: GetProductVariantsHandler, public: true, impersonable: true},
+	{method: "PUT", path: "/products/{id}/options", handler: SetProductOptionsHandler, permission: PermProductsWrite},
+	{method: "POST", path: "/products/{id}/variants", handler: CreateProductVariantHandler, permission: PermProductsWrite},
+	{method: "PUT", path: "/products/{id}/variants/{variant_id}", handler: UpdateProductVariantHandler, permission: PermProductsWrite},
+	{method: "DELETE", path: "/products/{id}/variants/{variant_id}", handler: DeleteProductVariantHandler, permission: PermProductsWrite},
+	{method: "GET", path: "/categories", handler: GetCategoriesHandler, public: true, impersonable: true},
+	{method: "GET", path: "/categories/{id}", handler: GetCategoryHandler, public: true, impersonable: true},
+	{method: "GET", path: "/categories/{id}/products", handler: GetCategoryProductsHandler, public: true, impersonable: true},
+	{method: "POST", path: "/categories", handler: CreateCategoryHandler, permission: PermCategoriesManage},
+	{method: "PUT", path: "/categories/{id}", handler: UpdateCategoryHandler, permission: PermCategoriesManage},
+	{method: "DELETE", path: "/categories/{id}", handler: DeleteCategoryHandler, permission: PermCategoriesManage},
+	{method: "GET", path: "/myproducts", handler: GetMyProducts, permission: PermProductsWrite, impersonable: true},
+	{method: "GET", path: "/cart", handler: GetCartHandler, permission: PermCartRead, impersonable: true},
+	{method: "POST", path: "/cart/add/{product_id}", handler: AddProductToCartHandler, permission: PermCartWrite},
+	{method: "PUT", path: "/cart/update/{product_id}", handler: UpdateCartItemHandler, permission: PermCartWrite},
+	{method: "DELETE", path: "/cart/remove/{product_id}", handler: RemoveProductFromCartHandler, permission: PermCartWrite},
+	{method: "GET", path: "/orders", handler: GetOrdersHandler, permission: PermOrdersRead, impersonable: true},
+	{method: "GET", path: "/orders/{order_id}", handler: GetIDOrderHandler, permission: PermOrdersRead, impersonable: true},
+	{method: "POST", path: "/orders/create", handler: CreateOrderHandler, permission: PermOrdersWrite},
+	{method: "PUT", path: "/orders/update/{order_id}", handler: UpdateOrderHandler, permission: PermOrdersWrite},
+	{method: "DELETE", path: "/orders/remove/{order_id}", handler: DeleteOrderHandler, permission: PermOrdersManage},
+	{method: "GET", path: "/admin/users", handler: AdminListUsersHandler, permission: PermUsersManage},
+	{method: "GET", path: "/admin/users/{id}", handler: AdminGetUserHandler, permission: PermUsersManage},
+	{method: "GET", path: "/admin/users/{id}/orders", handler: AdminGetUserOrdersHandler, permission: PermUsersManage},
+	{method: "GET", path: "/admin/users/{id}/products", handler: AdminGetUserProductsHandler, permission: PermUsersManage},
+	{method: "POST", path: "/admin/users/{id}/suspend", handler: AdminSuspendUserHandler, permission: PermUsersManage},
+	{method: "POST", path: "/admin/users/{id}/unsuspend", handler: AdminUnsuspendUserHandler, permission: PermUsersManage},
+	{method: "POST", path: "/admin/users/{id}/password-reset", handler: AdminForcePasswordResetHandler, permission: PermUsersManage},
+	{method: "PUT", path: "/admin/users/{id}/role", handler: AdminChangeRoleHandler, permission: PermUsersManage},
+	{method: "POST", path: "/admin/users/{id}/impersonate", handler: AdminImpersonateUserHandler, permission: PermUsersManage},
+	{method: "GET", path: "/admin/audit", handler: GetAuditEventsHandler, permission: PermAuditRead},
+	{method: "GET", path: "/admin/audit/export", handler: ExportAuditEventsHandler, permission: PermAuditRead},
+}
+
+// NewRouter returns the router serving every route of the API.
+func NewRouter() *mux.Router {
+	return newRouter(routes)
+}
+
+func newRouter(routes []route) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(AuthMiddleware)
+
+	for _, rt := range routes {
+		handler := rt.handler
+		if rt.permission != "" {
+			handler = Require(rt.permission, handler)
+		}
+		if rt.sessionOnly {
+			handler = SessionOnly(handler)
+		}
+
+		registered := router.HandleFunc(rt.path, handler).Methods(rt.method)
+		if rt.public {
+			Public(registered)
+		}
+		if rt.impersonable {
+			Impersonable(registered)
+		}
+	}
+
+	return router
+}
@@ -0,0 +1,343 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"shop/models"
+	"strings"
+	"testing"
+)
+
+var testRoles = []string{"customer", "seller", "admin"}
+
+// routeAccess is the expected access of one route: open to everyone, or to
+// signed-in users of the listed roles. sessionOnly routes refuse API keys.
+type routeAccess struct {
+	public      bool
+	roles       []string
+	sessionOnly bool
+}
+
+var (
+	publicAccess  = routeAccess{public: true}
+	anyRole       = routeAccess{roles: testRoles}
+	anyRoleNoKey  = routeAccess{roles: testRoles, sessionOnly: true}
+	sellersAccess = routeAccess{roles: []string{"seller", "admin"}}
+	adminsAccess  = routeAccess{roles: []string{"admin"}}
+)
+
+// routeSpec lists every route the API serves, by "METHOD path", with the
+// access it is meant to have. It is written independently of the route
+// table so that a change in either one shows up as a failure.
+var routeSpec = map[string]routeAccess{
+	"GET /.well-known/jwks.json":                  publicAccess,
+	"POST /register":                              publicAccess,
+	"POST /login":                                 publicAccess,
+	"POST /login/mfa":                             publicAccess,
+	"GET /oauth/{provider}/start":                 publicAccess,
+	"GET /oauth/{provider}/callback":              publicAccess,
+	"POST /oauth/{provider}/link":                 anyRoleNoKey,
+	"POST /token/refresh":                         publicAccess,
+	"POST /logout":                                anyRole,
+	"GET /verify-email":                           publicAccess,
+	"POST /verify-email":                          publicAccess,
+	"POST /password/forgot":                       publicAccess,
+	"GET /password/reset":                         publicAccess,
+	"POST /password/reset":                        publicAccess,
+	"POST /verify-email/resend":                   anyRole,
+	"POST /2fa/enroll":                            anyRoleNoKey,
+	"POST /2fa/confirm":                           anyRoleNoKey,
+	"POST /2fa/disable":                           anyRoleNoKey,
+	"GET /sessions":                               anyRoleNoKey,
+	"DELETE /sessions":                            anyRoleNoKey,
+	"DELETE /sessions/{id}":                       anyRoleNoKey,
+	"GET /apikeys":                                anyRoleNoKey,
+	"POST /apikeys":                               anyRoleNoKey,
+	"DELETE /apikeys/{id}":                        anyRoleNoKey,
+	"GET /profile":                                anyRole,
+	"PATCH /profile":                              anyRole,
+	"PUT /profile/update":                         anyRole,
+	"POST /profile/password":                      anyRoleNoKey,
+	"DELETE /profile":                             anyRoleNoKey,
+	"DELETE /profile/delete":                      anyRoleNoKey,
+	"POST /profile/delete/cancel":                 anyRoleNoKey,
+	"GET /profile/export":                         anyRole,
+	"GET /addresses":                              anyRole,
+	"POST /addresses":                             anyRole,
+	"GET /addresses/{id}":                         anyRole,
+	"PUT /addresses/{id}":                         anyRole,
+	"DELETE /addresses/{id}":                      anyRole,
+	"GET /profile/{username}":                     publicAccess,
+	"GET /products":                               publicAccess,
+	"GET /products/search":                        publicAccess,
+	"GET /products/{id}":                          publicAccess,
+	"POST /products/add":                          sellersAccess,
+	"PUT /products/{id}/update":                   sellersAccess,
+	"DELETE /products/{id}/delete":                sellersAccess,
+	"PUT /products/{id}/categories":               sellersAccess,
+	"GET /products/{id}/variants":                 publicAccess,
+	"PUT /products/{id}/options":                  sellersAccess,
+	"POST /products/{id}/variants":                sellersAccess,
+	"PUT /products/{id}/variants/{variant_id}":    sellersAccess,
+	"DELETE /products/{id}/variants/{variant_id}": sellersAccess,
+	"GET /categories":                             publicAccess,
+	"GET /categories/{id}":                        publicAccess,
+	"GET /categories/{id}/products":               publicAccess,
+	"POST /categories":                            adminsAccess,
+	"PUT /categories/{id}":                        adminsAccess,
+	"DELETE /categories/{id}":                     adminsAccess,
+	"GET /myproducts":                             sellersAccess,
+	"GET /cart":                                   anyRole,
+	"POST /cart/add/{product_id}":                 anyRole,
+	"PUT /cart/update/{product_id}":               anyRole,
+	"DELETE /cart/remove/{product_id}":            anyRole,
+	"GET /orders":                                 anyRole,
+	"GET /orders/{order_id}":                      anyRole,
+	"POST /orders/create":                         anyRole,
+	"PUT /orders/update/{order_id}":               anyRole,
+	"DELETE /orders/remove/{order_id}":            adminsAccess,
+	"GET /admin/users":                            adminsAccess,
+	"GET /admin/users/{id}":                       adminsAccess,
+	"GET /admin/users/{id}/orders":                adminsAccess,
+	"GET /admin/users/{id}/products":              adminsAccess,
+	"POST /admin/users/{id}/suspend":              adminsAccess,
+	"POST /admin/users/{id}/unsuspend":            adminsAccess,
+	"POST /admin/users/{id}/password-reset":       adminsAccess,
+	"PUT /admin/users/{id}/role":                  adminsAccess,
+	"POST /admin/users/{id}/impersonate":          adminsAccess,
+	"GET /admin/audit":                            adminsAccess,
+	"GET /admin/audit/export":                     adminsAccess,
+}
+
+var rolePermissionRow = regexp.MustCompile(`\('(\w+)',\s*'(\w+:\w+)'\)`)
+
+// seededRolePermissions reads the role grants from the migrations, so the
+// tests see the same permissions a fresh database hands out.
+func seededRolePermissions(t *testing.T) map[string][]string {
+	files, err := filepath.Glob("../models/migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grants := make(map[string][]string)
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, statement := range strings.Split(string(contents), ";") {
+			if !strings.Contains(statement, "INSERT INTO role_permissions") {
+				continue
+			}
+			for _, row := range rolePermissionRow.FindAllStringSubmatch(statement, -1) {
+				grants[row[1]] = append(grants[row[1]], row[2])
+			}
+		}
+	}
+	for _, role := range testRoles {
+		if len(grants[role]) == 0 {
+			t.Fatalf("no permissions seeded for role %q", role)
+		}
+	}
+	return grants
+}
+
+// withPrincipals makes AuthMiddleware resolve "Bearer <name>" to the named
+// principal.
+func withPrincipals(t *testing.T, principals map[string]*Principal) {
+	authenticateHeader = func(authorizationHeader string) (*Principal, error) {
+		principal, ok := principals[strings.TrimPrefix(authorizationHeader, "Bearer ")]
+		if !ok {
+			return nil, errors.New("unknown test principal")
+		}
+		return principal, nil
+	}
+	t.Cleanup(func() { authenticateHeader = authenticate })
+}
+
+var routeVariable = regexp.MustCompile(`\{\w+\}`)
+
+// stubbedRouter routes like the real router, with handlers that answer 200.
+func stubbedRouter() http.Handler {
+	stubbed := make([]route, len(routes))
+	for i, rt := range routes {
+		rt.handler = func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}
+		stubbed[i] = rt
+	}
+	return newRouter(stubbed)
+}
+
+func TestRouteTableMatchesSpec(t *testing.T) {
+	registered := make(map[string]bool)
+	for _, rt := range routes {
+		key := rt.method + " " + rt.path
+		if registered[key] {
+			t.Errorf("%s is registered twice", key)
+		}
+		registered[key] = true
+
+		access, ok := routeSpec[key]
+		if !ok {
+			t.Errorf("%s has no access spec", key)
+			continue
+		}
+		if rt.public != access.public || rt.sessionOnly != access.sessionOnly {
+			t.Errorf("%s: public = %v, sessionOnly = %v; want %v, %v", key, rt.public, rt.sessionOnly, access.public, access.sessionOnly)
+		}
+	}
+	for key := range routeSpec {
+		if !registered[key] {
+			t.Errorf("%s is in the spec but not registered", key)
+		}
+	}
+}
+
+func TestRouteAccess(t *testing.T) {
+	grants := seededRolePermissions(t)
+	principals := map[string]*Principal{
+		// An API key carrying every admin permission still can't reach the
+		// session-only routes.
+		"apikey": {UserID: 1, Role: "admin", Permissions: grants["admin"], APIKeyID: 1},
+	}
+	for _, role := range testRoles {
+		principals[role] = &Principal{UserID: 1, Role: role, Permissions: grants[role]}
+	}
+	withPrincipals(t, principals)
+
+	router := stubbedRouter()
+
+	for _, rt := range routes {
+		key := rt.method + " " + rt.path
+		access := routeSpec[key]
+		path := routeVariable.ReplaceAllString(rt.path, "1")
+
+		want := map[string]int{"": http.StatusUnauthorized, "apikey": http.StatusForbidden}
+		for _, role := range testRoles {
+			want[role] = http.StatusForbidden
+		}
+		for _, role := range access.roles {
+			want[role] = http.StatusOK
+		}
+		if !access.sessionOnly {
+			want["apikey"] = want["admin"]
+		}
+		if access.public {
+			for caller := range want {
+				want[caller] = http.StatusOK
+			}
+		}
+
+		for caller, status := range want {
+			r := httptest.NewRequest(rt.method, path, nil)
+			if caller != "" {
+				r.Header.Set("Authorization", "Bearer "+caller)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, r)
+
+			if w.Code != status {
+				t.Errorf("%s as %q: status = %d, want %d", key, caller, w.Code, status)
+			}
+		}
+	}
+}
+
+// TestOwnershipPolicies covers the routes that, past the permission check,
+// only let the owner act unless the caller holds the matching manage
+// permission.
+func TestOwnershipPolicies(t *testing.T) {
+	grants := seededRolePermissions(t)
+	const ownerID, otherID = 1, 2
+
+	type expectation struct{ owner, nonOwner bool }
+	cases := []struct {
+		routes []string
+		allows func(p *Principal, ownerID int) bool
+		want   map[string]expectation
+	}{
+		{
+			routes: []string{
+				"PUT /products/{id}/update",
+				"DELETE /products/{id}/delete",
+				"PUT /products/{id}/categories",
+				"PUT /products/{id}/options",
+				"POST /products/{id}/variants",
+				"PUT /products/{id}/variants/{variant_id}",
+				"DELETE /products/{id}/variants/{variant_id}",
+			},
+			allows: func(p *Principal, ownerID int) bool {
+				return canManageProduct(p, &models.Product{OwnerID: ownerID})
+			},
+			want: map[string]expectation{
+				"customer": {false, false},
+				"seller":   {true, false},
+				"admin":    {true, true},
+			},
+		},
+		{
+			routes: []string{"GET /orders/{order_id}"},
+			allows: func(p *Principal, ownerID int) bool {
+				return canViewOrder(p, &models.Order{UserID: ownerID})
+			},
+			want: map[string]expectation{
+				"customer": {true, false},
+				"seller":   {true, false},
+				"admin":    {true, true},
+			},
+		},
+		{
+			routes: []string{"PUT /orders/update/{order_id} (cancel unpaid)"},
+			allows: func(p *Principal, ownerID int) bool {
+				return canSetOrderStatus(p, &models.Order{UserID: ownerID, Status: "created"}, "cancelled")
+			},
+			want: map[string]expectation{
+				"customer": {true, false},
+				"seller":   {true, false},
+				"admin":    {true, true},
+			},
+		},
+		{
+			routes: []string{"PUT /orders/update/{order_id} (cancel shipped)"},
+			allows: func(p *Principal, ownerID int) bool {
+				return canSetOrderStatus(p, &models.Order{UserID: ownerID, Status: "shipped"}, "cancelled")
+			},
+			want: map[string]expectation{
+				"customer": {false, false},
+				"seller":   {false, false},
+				"admin":    {true, true},
+			},
+		},
+		{
+			routes: []string{"PUT /orders/update/{order_id} (mark paid)"},
+			allows: func(p *Principal, ownerID int) bool {
+				return canSetOrderStatus(p, &models.Order{UserID: ownerID, Status: "created"}, "paid")
+			},
+			want: map[string]expectation{
+				"customer": {false, false},
+				"seller":   {false, false},
+				"admin":    {true, true},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		for _, role := range testRoles {
+			p := &Principal{UserID: ownerID, Role: role, Permissions: grants[role]}
+			want := tc.want[role]
+			routes := strings.Join(tc.routes, ", ")
+			if got := tc.allows(p, ownerID); got != want.owner {
+				t.Errorf("%s as owning %s: allowed = %v, want %v", routes, role, got, want.owner)
+			}
+			if got := tc.allows(p, otherID); got != want.nonOwner {
+				t.Errorf("%s as non-owning %s: allowed = %v, want %v", routes, role, got, want.nonOwner)
+			}
+		}
+	}
+}
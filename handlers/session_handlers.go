@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"shop/models"
+)
+
+type SessionResponse struct {
+	*models.TokenFamily
+	Current bool `json:"current"`
+}
+
+func GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+
+	families, err := models.GetActiveTokenFamiliesByUserID(principal.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+
+	sessions := make([]SessionResponse, 0, len(families))
+	for _, family := range families {
+		sessions = append(sessions, SessionResponse{
+			TokenFamily: family,
+			Current:     family.ID == principal.SessionID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID := mux.Vars(r)["id"]
+
+	revoked, err := models.RevokeUserTokenFamily(currentPrincipal(r).UserID, sessionID)
+	if err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	if !revoked {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessionsHandler logs the user out everywhere except the session
+// making the request.
+func RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+
+	err := models.RevokeOtherTokenFamilies(principal.UserID, principal.SessionID)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"shop/models"
+	"time"
+)
+
+type TokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+func generateToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueRefreshToken stores a new refresh token in the given family and
+// returns its plaintext value; only the hash is kept in the database.
+func issueRefreshToken(familyID string) (string, error) {
+	plain, err := generateToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = models.CreateRefreshToken(&models.RefreshToken{
+		FamilyID:  familyID,
+		TokenHash: hashToken(plain),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return plain, nil
+}
+
+// startSession opens a new token family (a session) for the user and issues
+// the first access/refresh token pair in it.
+func startSession(r *http.Request, user *models.User) (*TokenResponse, error) {
+	familyID, err := generateToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	err = models.CreateTokenFamily(&models.TokenFamily{
+		ID:        familyID,
+		UserID:    user.ID,
+		UserAgent: userAgent,
+		IP:        clientIP(r),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return issueTokenPair(user, familyID)
+}
+
+func issueTokenPair(user *models.User, familyID string) (*TokenResponse, error) {
+	permissions, err := models.GetRolePermissions(user.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := CreateToken(user, permissions, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := issueRefreshToken(familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	stored, err := models.GetRefreshTokenByHash(hashToken(req.RefreshToken))
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	if stored == nil || stored.FamilyRevokedAt != nil || time.Now().After(stored.ExpiresAt) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	consumed, err := models.MarkRefreshTokenUsed(stored.ID)
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	if !consumed {
+		// A consumed token is being replayed: treat the whole family as stolen.
+		log.Printf("Refresh token reuse detected for user %d, revoking family %s", stored.UserID, stored.FamilyID)
+		if err := models.RevokeTokenFamily(stored.FamilyID); err != nil {
+			log.Println("Error revoking token family:", err)
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := models.GetUserByID(stored.UserID)
+	if err != nil || user == nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	response, err := issueTokenPair(user, stored.FamilyID)
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	err := models.RevokeTokenFamily(currentPrincipal(r).SessionID)
+	if err != nil {
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"shop/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+type TOTPEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" validate:"required,match=totp"`
+}
+
+type TOTPDisableRequest struct {
+	Password     string `json:"password" validate:"required"`
+	Code         string `json:"code" validate:"omitempty,match=totp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (req *TOTPDisableRequest) Validate() []FieldError {
+	return requireSecondFactor(req.Code, req.RecoveryCode)
+}
+
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type MFALoginRequest struct {
+	MFAToken     string `json:"mfa_token" validate:"required"`
+	Code         string `json:"code" validate:"omitempty,match=totp"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+func (req *MFALoginRequest) Validate() []FieldError {
+	return requireSecondFactor(req.Code, req.RecoveryCode)
+}
+
+func requireSecondFactor(code, recoveryCode string) []FieldError {
+	if code == "" && recoveryCode == "" {
+		return []FieldError{{Field: "code", Rule: "required", Message: "code or recovery_code is required"}}
+	}
+	return nil
+}
+
+// generateRecoveryCodes returns the plaintext codes shown to the user once
+// and the hashes that get stored.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))[:12]
+		codes[i] = code[:6] + "-" + code[6:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(normalized)
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code.
+func checkSecondFactor(user *models.User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return models.UseRecoveryCode(user.ID, hashRecoveryCode(recoveryCode))
+	}
+
+	step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return models.AdvanceTOTPStep(user.ID, step)
+}
+
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil || user == nil {
+		http.Error(w, "Failed to get user profile", http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	err = models.SetPendingTOTPSecret(user.ID, secret)
+	if err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TOTPEnrollmentResponse{
+		Secret:     secret,
+		OTPAuthURI: totpURI(tokenIssuer(), user.Username, secret),
+	})
+}
+
+func ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	user, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil || user == nil {
+		http.Error(w, "Failed to get user profile", http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabledAt != nil {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "No pending enrollment", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := verifyTOTP(user.TOTPSecret, req.Code, user.TOTPLastStep, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	err = models.EnableTOTP(user.ID, step, hashes)
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditTOTPEnable, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req TOTPDisableRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	user, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil || user == nil {
+		http.Error(w, "Failed to get user profile", http.StatusInternalServerError)
+		return
+	}
+
+	if user.TOTPEnabledAt == nil {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	if match, _ := CheckPassword(user.Password, req.Password); !match {
+		http.Error(w, "Invalid password or code", http.StatusForbidden)
+		return
+	}
+
+	ok, err := checkSecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid password or code", http.StatusForbidden)
+		return
+	}
+
+	err = models.DisableTOTP(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{Action: AuditTOTPDisable, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginMFAHandler is the second login step: it trades the challenge token
+// from LoginHandler plus a TOTP or recovery code for a real session.
+func LoginMFAHandler(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	claims, err := VerifyMFAToken(req.MFAToken)
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := models.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if user == nil || user.TOTPEnabledAt == nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	throttle := newLoginThrottle(r, user.Username)
+	if wait := throttle.retryAfter(); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	ok, err := checkSecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		throttle.fail()
+		auditLogin(r, AuditLoginFailed, "totp", user.Username, user, "invalid_code")
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	throttle.succeed()
+
+	if accountSuspended(w, user) {
+		auditLogin(r, AuditLoginFailed, "totp", user.Username, user, "suspended")
+		return
+	}
+
+	response, err := startSession(r, user)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auditLogin(r, AuditLogin, "totp", user.Username, user, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
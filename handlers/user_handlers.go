@@ -2,25 +2,35 @@ package handlers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"shop/models"
+	"strings"
 )
 
 type UserRegistration struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Email    string `json:"email"`
+	Username string `json:"username" validate:"required,min=3,max=32,match=username"`
+	Password string `json:"password" validate:"required,min=8,max=128"`
+	Email    string `json:"email" validate:"required,email,max=254"`
+	// Role is optional; only customer and seller accounts can be self-registered.
+	Role string `json:"role" validate:"omitempty,oneof=customer seller"`
 }
+
+func (u *UserRegistration) Normalize() {
+	u.Username = strings.TrimSpace(u.Username)
+	u.Email = strings.TrimSpace(u.Email)
+}
+
+// UserLogin only requires the fields: accounts created before the current
+// password rules must still be able to log in.
 type UserLogin struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required,max=254"`
+	Password string `json:"password" validate:"required,max=128"`
 }
 
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var user UserRegistration
-	err := json.NewDecoder(r.Body).Decode(&user)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !decodeJSON(w, r, &user) {
 		return
 	}
 
@@ -31,11 +41,22 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if user.Role == "" {
+		user.Role = models.RoleCustomer
+	}
+
+	passwordHash, err := HashPassword(user.Password)
+	if err != nil {
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return
+	}
+
 	// Создание пользователя
 	newUser := models.User{
 		Username: user.Username,
-		Password: user.Password,
+		Password: passwordHash,
 		Email:    user.Email,
+		Role:     user.Role,
 	}
 	err = models.CreateUser(&newUser)
 	if err != nil {
@@ -43,43 +64,103 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token, err := CreateToken(newUser.Username)
+	if err := sendVerificationEmail(&newUser); err != nil {
+		log.Println("Error sending verification email:", err)
+	}
+
+	response, err := startSession(r, &newUser)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	response := map[string]string{"token": token}
+
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
+}
 
-	w.Header().Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
+// accountSuspended rejects logins to suspended accounts. Callers check it only
+// after the credentials, so it doesn't tell strangers which accounts exist.
+func accountSuspended(w http.ResponseWriter, user *models.User) bool {
+	if user.SuspendedAt != nil {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return true
+	}
+	return false
 }
 
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	var userLogin UserLogin
-	err := json.NewDecoder(r.Body).Decode(&userLogin)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !decodeJSON(w, r, &userLogin) {
+		return
+	}
+
+	throttle := newLoginThrottle(r, userLogin.Username)
+	if wait := throttle.retryAfter(); wait > 0 {
+		tooManyAttempts(w, wait)
 		return
 	}
 
 	user, err := models.GetUserByUsername(userLogin.Username)
 	if err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if user == nil || user.AnonymizedAt != nil {
+		CheckPassword(dummyHash, userLogin.Password)
+		throttle.fail()
+		auditLogin(r, AuditLoginFailed, "password", userLogin.Username, nil, "unknown_user")
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	if user.Password != userLogin.Password {
+	match, needsRehash := CheckPassword(user.Password, userLogin.Password)
+	if !match {
+		throttle.fail()
+		auditLogin(r, AuditLoginFailed, "password", userLogin.Username, user, "invalid_password")
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	token, err := CreateToken(user.Username)
+	if accountSuspended(w, user) {
+		auditLogin(r, AuditLoginFailed, "password", userLogin.Username, user, "suspended")
+		return
+	}
+
+	if needsRehash {
+		if passwordHash, err := HashPassword(userLogin.Password); err == nil {
+			if err := models.UpdateUserPassword(user.ID, passwordHash); err != nil {
+				log.Println("Error upgrading password hash:", err)
+			}
+		}
+	}
+
+	if user.TOTPEnabledAt != nil {
+		mfaToken, err := CreateMFAToken(user)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresIn:   int(mfaTokenTTL.Seconds()),
+		})
+		return
+	}
+
+	// With two-factor enabled the counter is only reset after the second step,
+	// so knowing the password doesn't grant unlimited code guesses.
+	throttle.succeed()
+
+	response, err := startSession(r, user)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	auditLogin(r, AuditLogin, "password", user.Username, user, "")
 
-	response := map[string]string{"token": token}
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
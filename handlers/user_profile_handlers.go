@@ -2,97 +2,247 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
-	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
+	"log"
 	"net/http"
 	"shop/models"
+	"strconv"
 	"strings"
 )
 
 func GetProfileHandler(w http.ResponseWriter, r *http.Request) {
-	currentUser := getCurrentUser(r)
+	currentUser, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil {
+		http.Error(w, "Failed to get user profile", http.StatusInternalServerError)
+		return
+	}
 	if currentUser == nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(currentUser)
+	json.NewEncoder(w).Encode(privateProfile(currentUser))
 }
-func getCurrentUser(r *http.Request) *models.User {
-	authorizationHeader := r.Header.Get("Authorization")
-	if authorizationHeader == "" {
-		return nil
-	}
-	tokenString := strings.Replace(authorizationHeader, "Bearer ", "", 1)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+
+// profilePatchFields are the members a profile merge patch may contain.
+// The password has its own endpoint because it needs the current password.
+var profilePatchFields = map[string]bool{
+	"username": true,
+	"email":    true,
+}
+
+// ProfileFields holds the patchable profile members after the patch has been
+// applied. The members in the patch are validated with the same rules as on
+// registration.
+type ProfileFields struct {
+	Username string `json:"username" validate:"required,min=3,max=32,match=username"`
+	Email    string `json:"email" validate:"required,email,max=254"`
+}
+
+// applyProfilePatch merges patch into fields. Malformed or unknown members
+// are reported with 400 and rule violations with 422. Only the members in
+// the patch are validated, so an account whose current username predates
+// the rules can still change its email.
+func applyProfilePatch(fields ProfileFields, patch map[string]json.RawMessage) (ProfileFields, int, []FieldError) {
+	var errs []FieldError
+	for field, raw := range patch {
+		if field == "password" {
+			errs = append(errs, FieldError{Field: field, Rule: "read_only", Message: "use POST /profile/password to change the password"})
+			continue
+		}
+		if !profilePatchFields[field] {
+			errs = append(errs, FieldError{Field: field, Rule: "unknown", Message: "is not a recognized field"})
+			continue
+		}
+
+		var value *string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			errs = append(errs, FieldError{Field: field, Rule: "type", Message: "must be a string"})
+			continue
+		}
+		if value == nil {
+			errs = append(errs, FieldError{Field: field, Rule: "required", Message: "cannot be removed"})
+			continue
+		}
+		switch field {
+		case "username":
+			fields.Username = strings.TrimSpace(*value)
+		case "email":
+			fields.Email = strings.TrimSpace(*value)
 		}
-		return []byte("your_secret_key"), nil
-	})
-	if err != nil {
-		fmt.Println("Error parsing token:", err)
-		return nil
 	}
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		username := claims["username"].(string)
+	if len(errs) > 0 {
+		return fields, http.StatusBadRequest, errs
+	}
 
-		user, err := models.GetUserByUsername(username)
-		if err != nil {
-			fmt.Println("Error fetching user:", err)
-			return nil
+	for _, err := range validateRequest(&fields) {
+		if _, patched := patch[err.Field]; patched {
+			errs = append(errs, err)
 		}
-		return user
 	}
-	return nil
+	if len(errs) > 0 {
+		return fields, http.StatusUnprocessableEntity, errs
+	}
+	return fields, http.StatusOK, nil
 }
-func UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
-	currentUser := getCurrentUser(r)
 
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=128"`
+}
+
+// UpdateProfileHandler applies a JSON merge patch (RFC 7396) to the caller's
+// profile: members that are absent stay unchanged.
+func UpdateProfileHandler(w http.ResponseWriter, r *http.Request) {
+	currentUser, err := models.GetUserByID(currentPrincipal(r).UserID)
+	if err != nil {
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
 	if currentUser == nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
 
-	var updatedProfile models.User
-	err := json.NewDecoder(r.Body).Decode(&updatedProfile)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	var patch map[string]json.RawMessage
+	if !decodeJSON(w, r, &patch) {
+		return
+	}
+	if patch == nil {
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid request body", []FieldError{
+			{Field: "", Rule: "type", Message: "must be an object"},
+		})
 		return
 	}
 
-	if currentUser.ID != updatedProfile.ID {
-		http.Error(w, "You can only update your own profile", http.StatusForbidden)
+	fields, status, errs := applyProfilePatch(ProfileFields{Username: currentUser.Username, Email: currentUser.Email}, patch)
+	if len(errs) > 0 {
+		message := "Invalid request body"
+		if status == http.StatusUnprocessableEntity {
+			message = "Validation failed"
+		}
+		writeValidationErrors(w, status, message, errs)
 		return
 	}
 
-	err = models.UpdateUserProfile(&updatedProfile)
+	updated := *currentUser
+	updated.Username = fields.Username
+	updated.Email = fields.Email
+
+	if updated.Username != currentUser.Username {
+		existing, err := models.GetUserByUsername(updated.Username)
+		if err != nil {
+			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+	}
+
+	emailChanged := updated.Email != currentUser.Email
+	if emailChanged {
+		existing, err := models.GetUserByEmail(updated.Email)
+		if err != nil {
+			http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+			return
+		}
+		if existing != nil {
+			http.Error(w, "Email is already in use", http.StatusConflict)
+			return
+		}
+	}
+
+	err = models.UpdateUserProfile(&updated)
 	if err != nil {
+		if models.IsUniqueViolation(err) {
+			http.Error(w, "Username or email is already in use", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProfileUpdate,
+		TargetType: "user",
+		TargetID:   strconv.Itoa(updated.ID),
+		Changes: auditChanges(
+			map[string]interface{}{"username": currentUser.Username, "email": currentUser.Email},
+			map[string]interface{}{"username": updated.Username, "email": updated.Email},
+		),
+	})
+
+	if emailChanged {
+		updated.EmailVerifiedAt = nil
+		if err := sendVerificationEmail(&updated); err != nil {
+			log.Println("Error sending verification email:", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(privateProfile(&updated))
 }
-func DeleteProfileHandler(w http.ResponseWriter, r *http.Request) {
-	currentUser := getCurrentUser(r)
 
-	if currentUser == nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+// ChangePasswordHandler requires the current password and logs out every
+// other session once the new one is set. Wrong current passwords count
+// towards the same lockout as failed logins, so a stolen access token can't
+// be used to guess the password.
+func ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+
+	var req ChangePasswordRequest
+	if !decodeJSON(w, r, &req) {
 		return
 	}
 
-	err := models.DeleteUserProfile(currentUser.ID)
+	user, err := models.GetUserByID(principal.UserID)
+	if err != nil || user == nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	throttle := newLoginThrottle(r, user.Username)
+	if wait := throttle.retryAfter(); wait > 0 {
+		tooManyAttempts(w, wait)
+		return
+	}
+
+	if match, _ := CheckPassword(user.Password, req.CurrentPassword); !match {
+		throttle.fail()
+		recordAudit(r, models.AuditEvent{
+			Action:     AuditPasswordChangeFailed,
+			TargetType: "user",
+			TargetID:   strconv.Itoa(user.ID),
+			Details:    map[string]interface{}{"reason": "invalid_password"},
+		})
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+	throttle.succeed()
+
+	passwordHash, err := HashPassword(req.NewPassword)
 	if err != nil {
-		http.Error(w, "Failed to delete profile", http.StatusInternalServerError)
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
 		return
 	}
 
-	// Отправка успешного ответа
-	w.WriteHeader(http.StatusOK)
-}
+	err = models.UpdateUserPassword(user.ID, passwordHash)
+	if err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	err = models.RevokeOtherTokenFamilies(user.ID, principal.SessionID)
+	if err != nil {
+		http.Error(w, "Failed to revoke existing sessions", http.StatusInternalServerError)
+		return
+	}
 
+	recordAudit(r, models.AuditEvent{Action: AuditPasswordChange, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+	w.WriteHeader(http.StatusNoContent)
+}
 func GetUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	username := vars["username"]
@@ -109,5 +259,5 @@ func GetUserProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(profileView(user, currentPrincipal(r)))
 }
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestApplyProfilePatch(t *testing.T) {
+	legacy := ProfileFields{Username: "al", Email: "al@example.com"}
+
+	for name, tc := range map[string]struct {
+		current    ProfileFields
+		patch      string
+		wantStatus int
+		wantFields ProfileFields
+		wantErrors []string
+	}{
+		"email change with a legacy username": {
+			current:    legacy,
+			patch:      `{"email": " new@example.com "}`,
+			wantStatus: http.StatusOK,
+			wantFields: ProfileFields{Username: "al", Email: "new@example.com"},
+		},
+		"invalid username in the patch": {
+			current:    legacy,
+			patch:      `{"username": "a b"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{"username"},
+		},
+		"invalid email in the patch": {
+			current:    ProfileFields{Username: "alice", Email: "alice@example.com"},
+			patch:      `{"email": "not-an-email"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []string{"email"},
+		},
+		"removal": {
+			current:    legacy,
+			patch:      `{"email": null}`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []string{"email"},
+		},
+		"password": {
+			current:    legacy,
+			patch:      `{"password": "secret123"}`,
+			wantStatus: http.StatusBadRequest,
+			wantErrors: []string{"password"},
+		},
+	} {
+		var patch map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(tc.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+
+		fields, status, errs := applyProfilePatch(tc.current, patch)
+
+		if status != tc.wantStatus {
+			t.Errorf("%s: status = %d, want %d (errors %v)", name, status, tc.wantStatus, errs)
+			continue
+		}
+		if tc.wantErrors == nil {
+			if fields != tc.wantFields {
+				t.Errorf("%s: fields = %+v, want %+v", name, fields, tc.wantFields)
+			}
+			continue
+		}
+		if len(errs) != len(tc.wantErrors) {
+			t.Errorf("%s: errors = %v, want errors for %v", name, errs, tc.wantErrors)
+			continue
+		}
+		for i, field := range tc.wantErrors {
+			if errs[i].Field != field {
+				t.Errorf("%s: error %d is for %q, want %q", name, i, errs[i].Field, field)
+			}
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxRequestBodyBytes caps every JSON request body read through decodeJSON.
+const maxRequestBodyBytes = 1 << 20
+
+// FieldError describes one invalid field. Field is the JSON path of the
+// field, Rule the name of the failed rule, so clients can map errors to
+// inputs without parsing Message.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type ValidationErrorResponse struct {
+	Error  string       `json:"error"`
+	Errors []FieldError `json:"errors"`
+}
+
+// validator is implemented by request types with rules that struct tags
+// can't express, e.g. ones that depend on several fields.
+type validator interface {
+	Validate() []FieldError
+}
+
+// normalizer is implemented by request types that clean up their input
+// (trimming, case folding) before validation.
+type normalizer interface {
+	Normalize()
+}
+
+// Named patterns for the match= rule.
+var validationPatterns = map[string]*regexp.Regexp{
+	"username": regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`),
+	"totp":     regexp.MustCompile(`^\d{6}$`),
+	"slug":     regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`),
+	"sku":      regexp.MustCompile(`^[A-Za-z0-9]+([._-][A-Za-z0-9]+)*$`),
+}
+
+func writeValidationErrors(w http.ResponseWriter, status int, message string, errs []FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ValidationErrorResponse{Error: message, Errors: errs})
+}
+
+// decodeJSON strictly decodes the request body into dst and validates it.
+// Bodies over maxRequestBodyBytes, unknown fields, trailing data and type
+// mismatches are rejected with 400 (413 for size), failed rules with 422.
+// It writes the error response itself and returns false on failure.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(dst)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("body must contain a single JSON value")
+	}
+	if err != nil {
+		writeDecodeError(w, err)
+		return false
+	}
+
+	if errs := validateRequest(dst); len(errs) > 0 {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", errs)
+		return false
+	}
+	return true
+}
+
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		writeValidationErrors(w, http.StatusRequestEntityTooLarge, "Request body too large", []FieldError{
+			{Field: "", Rule: "max_bytes", Message: fmt.Sprintf("must not exceed %d bytes", maxBytesErr.Limit)},
+		})
+	case errors.As(err, &typeErr):
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid request body", []FieldError{
+			{Field: typeErr.Field, Rule: "type", Message: "must be " + jsonTypeName(typeErr.Type)},
+		})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid request body", []FieldError{
+			{Field: field, Rule: "unknown", Message: "is not a recognized field"},
+		})
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid request body", []FieldError{
+			{Field: "", Rule: "json", Message: "must be valid JSON"},
+		})
+	default:
+		writeValidationErrors(w, http.StatusBadRequest, "Invalid request body", []FieldError{
+			{Field: "", Rule: "json", Message: err.Error()},
+		})
+	}
+}
+
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	}
+	return "an object"
+}
+
+// validateRequest normalizes v if it supports it, checks the validate tags
+// and then any Validate method.
+func validateRequest(v interface{}) []FieldError {
+	if n, ok := v.(normalizer); ok {
+		n.Normalize()
+	}
+
+	errs := validateStruct(reflect.ValueOf(v), "")
+	if custom, ok := v.(validator); ok {
+		errs = append(errs, custom.Validate()...)
+	}
+	return errs
+}
+
+// validateStruct walks the struct fields and applies their validate tags.
+// Rules are comma separated: required, omitempty, min=N, max=N, gt=N,
+// email, oneof=a b c and match=<pattern name>. min and max count characters
+// for strings, elements for slices and compare the value for numbers.
+// Nested and embedded structs are validated recursively.
+func validateStruct(v reflect.Value, prefix string) []FieldError {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var errs []FieldError
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i)
+
+		if field.Anonymous {
+			errs = append(errs, validateStruct(value, prefix)...)
+			continue
+		}
+
+		name := jsonFieldName(field)
+		if name == "-" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		if tag := field.Tag.Get("validate"); tag != "" {
+			if fieldErr := checkRules(value, path, tag); fieldErr != nil {
+				errs = append(errs, *fieldErr)
+				continue
+			}
+		}
+
+		switch indirectKind(value) {
+		case reflect.Struct:
+			errs = append(errs, validateStruct(value, path)...)
+		case reflect.Slice:
+			slice := reflect.Indirect(value)
+			for j := 0; j < slice.Len(); j++ {
+				errs = append(errs, validateStruct(slice.Index(j), fmt.Sprintf("%s[%d]", path, j))...)
+			}
+		}
+	}
+	return errs
+}
+
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+func indirectKind(v reflect.Value) reflect.Kind {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Invalid
+		}
+		v = v.Elem()
+	}
+	return v.Kind()
+}
+
+// isBlank treats nil pointers, empty collections, whitespace-only strings
+// and zero values as missing. A pointer to a zero number or false counts as
+// present, which is how optional fields tell "0" apart from "not sent".
+func isBlank(v reflect.Value) bool {
+	pointer := false
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return true
+		}
+		v = v.Elem()
+		pointer = true
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return strings.TrimSpace(v.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return !pointer && v.IsZero()
+}
+
+// checkRules returns the first rule that value breaks, if any.
+func checkRules(value reflect.Value, path, tag string) *FieldError {
+	rules := strings.Split(tag, ",")
+	blank := isBlank(value)
+
+	for _, rule := range rules {
+		switch rule {
+		case "required":
+			if blank {
+				return &FieldError{Field: path, Rule: "required", Message: "is required"}
+			}
+		case "omitempty":
+			if blank {
+				return nil
+			}
+		}
+	}
+
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	for _, rule := range rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		var message string
+
+		switch name {
+		case "required", "omitempty":
+			continue
+		case "min", "max", "gt":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				panic(fmt.Sprintf("validate: bad %s argument %q on %s", name, arg, path))
+			}
+			message = checkLimit(value, name, limit)
+		case "email":
+			address, err := mail.ParseAddress(value.String())
+			if err != nil || address.Address != value.String() || !strings.Contains(address.Address, "@") {
+				message = "must be a valid email address"
+			}
+		case "oneof":
+			options := strings.Fields(arg)
+			if !containsString(options, fmt.Sprint(value.Interface())) {
+				message = "must be one of: " + strings.Join(options, ", ")
+			}
+		case "match":
+			pattern, ok := validationPatterns[arg]
+			if !ok {
+				panic(fmt.Sprintf("validate: unknown pattern %q on %s", arg, path))
+			}
+			if !pattern.MatchString(value.String()) {
+				message = "has an invalid format"
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q on %s", name, path))
+		}
+
+		if message != "" {
+			return &FieldError{Field: path, Rule: name, Message: message}
+		}
+	}
+	return nil
+}
+
+func checkLimit(value reflect.Value, rule string, limit float64) string {
+	var n float64
+	unit := ""
+	switch value.Kind() {
+	case reflect.String:
+		n = float64(utf8.RuneCountInString(value.String()))
+		unit = " characters"
+	case reflect.Slice, reflect.Map:
+		n = float64(value.Len())
+		unit = " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n = float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = value.Float()
+	default:
+		return ""
+	}
+
+	limitText := strconv.FormatFloat(limit, 'f', -1, 64)
+	switch {
+	case rule == "min" && n < limit:
+		if unit != "" {
+			return "must have at least " + limitText + unit
+		}
+		return "must be at least " + limitText
+	case rule == "max" && n > limit:
+		if unit != "" {
+			return "must have at most " + limitText + unit
+		}
+		return "must be at most " + limitText
+	case rule == "gt" && n <= limit:
+		return "must be greater than " + limitText
+	}
+	return ""
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
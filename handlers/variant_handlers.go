@@ -0,0 +1,400 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"net/http"
+	"shop/models"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type ProductOptionRequest struct {
+	Name   string   `json:"name" validate:"required,max=50"`
+	Values []string `json:"values" validate:"required,max=100"`
+}
+
+type ProductOptionsRequest struct {
+	Options []ProductOptionRequest `json:"options" validate:"max=5"`
+}
+
+func (req *ProductOptionsRequest) Normalize() {
+	for i := range req.Options {
+		req.Options[i].Name = strings.TrimSpace(req.Options[i].Name)
+		for j, value := range req.Options[i].Values {
+			req.Options[i].Values[j] = strings.TrimSpace(value)
+		}
+	}
+}
+
+// Validate rejects repeated option names and empty, overlong or repeated
+// values.
+func (req *ProductOptionsRequest) Validate() []FieldError {
+	var errs []FieldError
+	names := make(map[string]bool)
+	for i, option := range req.Options {
+		name := strings.ToLower(option.Name)
+		if names[name] {
+			errs = append(errs, FieldError{Field: "options[" + strconv.Itoa(i) + "].name", Rule: "unique", Message: "is already used by another option"})
+		}
+		names[name] = true
+
+		values := make(map[string]bool)
+		for j, value := range option.Values {
+			field := "options[" + strconv.Itoa(i) + "].values[" + strconv.Itoa(j) + "]"
+			switch {
+			case value == "":
+				errs = append(errs, FieldError{Field: field, Rule: "required", Message: "is required"})
+			case len([]rune(value)) > 100:
+				errs = append(errs, FieldError{Field: field, Rule: "max", Message: "must be at most 100 characters"})
+			case values[value]:
+				errs = append(errs, FieldError{Field: field, Rule: "unique", Message: "is listed twice"})
+			}
+			values[value] = true
+		}
+	}
+	return errs
+}
+
+type ProductVariantRequest struct {
+	SKU string `json:"sku" validate:"required,max=64,match=sku"`
+	// Options picks one value for each option of the product.
+	Options map[string]string `json:"options" validate:"required"`
+	// Price defaults to the product's price.
+	Price         *float64 `json:"price" validate:"omitempty,gt=0,max=1000000"`
+	StockQuantity int      `json:"stock_quantity" validate:"min=0,max=1000000"`
+}
+
+func (req *ProductVariantRequest) Normalize() {
+	req.SKU = strings.TrimSpace(req.SKU)
+	options := make(map[string]string, len(req.Options))
+	for name, value := range req.Options {
+		options[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	req.Options = options
+}
+
+// ProductVariantsResponse is a product's option definitions with its
+// variants.
+type ProductVariantsResponse struct {
+	Options  []models.ProductOption   `json:"options"`
+	Variants []*models.ProductVariant `json:"variants"`
+}
+
+// checkVariantOptions reports the ways options fails to pick exactly one
+// allowed value for each of the product's options.
+func checkVariantOptions(defs []models.ProductOption, options map[string]string) []FieldError {
+	var errs []FieldError
+	known := make(map[string]bool, len(defs))
+	for _, def := range defs {
+		known[def.Name] = true
+		value, ok := options[def.Name]
+		if !ok {
+			errs = append(errs, FieldError{Field: "options." + def.Name, Rule: "required", Message: "is required"})
+			continue
+		}
+		if !containsString(def.Values, value) {
+			errs = append(errs, FieldError{Field: "options." + def.Name, Rule: "oneof", Message: "must be one of: " + strings.Join(def.Values, ", ")})
+		}
+	}
+
+	var unknown []string
+	for name := range options {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		errs = append(errs, FieldError{Field: "options." + name, Rule: "unknown", Message: "is not an option of this product"})
+	}
+	return errs
+}
+
+// managedProductFromRequest loads the product in the id route variable and
+// makes sure the caller may edit it. It writes the error response itself and
+// returns false on failure.
+func managedProductFromRequest(w http.ResponseWriter, r *http.Request) (*models.Product, bool) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	product, err := models.GetProductByID(productID)
+	if err != nil {
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+		return nil, false
+	}
+	if product == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return nil, false
+	}
+	if !canManageProduct(currentPrincipal(r), product) {
+		http.Error(w, "You are not authorized to update this product", http.StatusForbidden)
+		return nil, false
+	}
+	return product, true
+}
+
+func variantIDFromRequest(w http.ResponseWriter, r *http.Request) (int, bool) {
+	variantID, err := strconv.Atoi(mux.Vars(r)["variant_id"])
+	if err != nil {
+		http.Error(w, "Invalid variant ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return variantID, true
+}
+
+func variantAuditFields(variant *models.ProductVariant) map[string]interface{} {
+	return map[string]interface{}{
+		"sku":            variant.SKU,
+		"options":        variant.Options,
+		"price":          variant.Price,
+		"stock_quantity": variant.StockQuantity,
+	}
+}
+
+func writeProductVariants(w http.ResponseWriter, productID int) {
+	options, err := models.GetProductOptions([]int{productID})
+	if err != nil {
+		http.Error(w, "Failed to fetch variants", http.StatusInternalServerError)
+		return
+	}
+	variants, err := models.GetProductVariants([]int{productID})
+	if err != nil {
+		http.Error(w, "Failed to fetch variants", http.StatusInternalServerError)
+		return
+	}
+
+	response := ProductVariantsResponse{
+		Options:  []models.ProductOption{},
+		Variants: []*models.ProductVariant{},
+	}
+	response.Options = append(response.Options, options[productID]...)
+	response.Variants = append(response.Variants, variants[productID]...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func GetProductVariantsHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid product ID", http.StatusBadRequest)
+		return
+	}
+
+	product, err := models.GetProductByID(productID)
+	if err != nil {
+		http.Error(w, "Failed to get product information", http.StatusInternalServerError)
+		return
+	}
+	if product == nil {
+		http.Error(w, "Product not found", http.StatusNotFound)
+		return
+	}
+
+	writeProductVariants(w, productID)
+}
+
+// SetProductOptionsHandler replaces the product's option definitions.
+// Existing variants must still pick one allowed value for every option.
+func SetProductOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	product, ok := managedProductFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req ProductOptionsRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	options := make([]models.ProductOption, len(req.Options))
+	for i, option := range req.Options {
+		options[i] = models.ProductOption{Name: option.Name, Values: option.Values}
+	}
+
+	variants, err := models.GetProductVariants([]int{product.ID})
+	if err != nil {
+		http.Error(w, "Failed to update options", http.StatusInternalServerError)
+		return
+	}
+	for _, variant := range variants[product.ID] {
+		if len(checkVariantOptions(options, variant.Options)) > 0 {
+			http.Error(w, "Variant "+variant.SKU+" doesn't fit the new options; update or delete it first", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := models.SetProductOptions(product.ID, options); err != nil {
+		http.Error(w, "Failed to update options", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductOptionsSet,
+		TargetType: "product",
+		TargetID:   strconv.Itoa(product.ID),
+		Details:    map[string]interface{}{"options": options},
+	})
+
+	writeProductVariants(w, product.ID)
+}
+
+// checkVariantRequest validates the variant's options against the product's
+// definitions. It writes the error response itself and returns false on
+// failure.
+func checkVariantRequest(w http.ResponseWriter, productID int, req *ProductVariantRequest) bool {
+	options, err := models.GetProductOptions([]int{productID})
+	if err != nil {
+		http.Error(w, "Failed to get product options", http.StatusInternalServerError)
+		return false
+	}
+	if len(options[productID]) == 0 {
+		http.Error(w, "Define the product's options before adding variants", http.StatusConflict)
+		return false
+	}
+	if errs := checkVariantOptions(options[productID], req.Options); len(errs) > 0 {
+		writeValidationErrors(w, http.StatusUnprocessableEntity, "Validation failed", errs)
+		return false
+	}
+	return true
+}
+
+func CreateProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	product, ok := managedProductFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req ProductVariantRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if !checkVariantRequest(w, product.ID, &req) {
+		return
+	}
+
+	variant := &models.ProductVariant{
+		ProductID:     product.ID,
+		SKU:           req.SKU,
+		Options:       req.Options,
+		Price:         req.Price,
+		StockQuantity: req.StockQuantity,
+	}
+	if err := models.CreateProductVariant(variant); err != nil {
+		if models.IsUniqueViolation(err) {
+			http.Error(w, "A variant with this SKU or these options already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to create variant", http.StatusInternalServerError)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductVariantCreate,
+		TargetType: "product_variant",
+		TargetID:   strconv.Itoa(variant.ID),
+		Details:    map[string]interface{}{"product_id": product.ID},
+		Changes:    auditChanges(nil, variantAuditFields(variant)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(variant)
+}
+
+func UpdateProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	product, ok := managedProductFromRequest(w, r)
+	if !ok {
+		return
+	}
+	variantID, ok := variantIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	var req ProductVariantRequest
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+
+	existing, err := models.GetProductVariant(product.ID, variantID)
+	if err != nil {
+		http.Error(w, "Failed to update variant", http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return
+	}
+	if !checkVariantRequest(w, product.ID, &req) {
+		return
+	}
+
+	variant := &models.ProductVariant{
+		ID:            variantID,
+		ProductID:     product.ID,
+		SKU:           req.SKU,
+		Options:       req.Options,
+		Price:         req.Price,
+		StockQuantity: req.StockQuantity,
+	}
+	updated, err := models.UpdateProductVariant(variant)
+	if err != nil {
+		if models.IsUniqueViolation(err) {
+			http.Error(w, "A variant with this SKU or these options already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update variant", http.StatusInternalServerError)
+		return
+	}
+	if !updated {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductVariantUpdate,
+		TargetType: "product_variant",
+		TargetID:   strconv.Itoa(variantID),
+		Details:    map[string]interface{}{"product_id": product.ID},
+		Changes:    auditChanges(variantAuditFields(existing), variantAuditFields(variant)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(variant)
+}
+
+// DeleteProductVariantHandler removes the variant from carts as well. Past
+// orders keep its SKU.
+func DeleteProductVariantHandler(w http.ResponseWriter, r *http.Request) {
+	product, ok := managedProductFromRequest(w, r)
+	if !ok {
+		return
+	}
+	variantID, ok := variantIDFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := models.DeleteProductVariant(product.ID, variantID)
+	if err != nil {
+		http.Error(w, "Failed to delete variant", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Variant not found", http.StatusNotFound)
+		return
+	}
+
+	recordAudit(r, models.AuditEvent{
+		Action:     AuditProductVariantDelete,
+		TargetType: "product_variant",
+		TargetID:   strconv.Itoa(variantID),
+		Details:    map[string]interface{}{"product_id": product.ID},
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailerWritesMessage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	m := &FileMailer{Dir: dir, From: "shop@example.com"}
+
+	err := m.Send(Message{
+		To:      "user@example.com",
+		Subject: "Confirm your email address",
+		Body:    "Open this link:\n\nhttp://localhost:8080/verify-email?token=abc\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("outbox has %v (err %v), want one .eml file", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(data)
+
+	for _, want := range []string{
+		"From: shop@example.com\r\n",
+		"To: user@example.com\r\n",
+		"Subject: Confirm your email address\r\n",
+		"\r\n\r\nOpen this link:\r\n\r\nhttp://localhost:8080/verify-email?token=abc\r\n",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message doesn't contain %q:\n%s", want, message)
+		}
+	}
+}
+
+func TestFileMailerKeepsMessagesApart(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir}
+
+	for i := 0; i < 3; i++ {
+		if err := m.Send(Message{To: "user@example.com", Subject: "Hello"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 3 {
+		t.Errorf("outbox has %d files, want 3", len(files))
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	message := string(format("shop@example.com", Message{
+		To:      "user@example.com\r\nBcc: victim@example.com",
+		Subject: "Hi\nBcc: victim@example.com",
+	}))
+
+	if strings.Contains(message, "\r\nBcc:") || strings.Contains(message, "\nBcc:") {
+		t.Errorf("header injection got through:\n%s", message)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("MAIL_DRIVER", "")
+	t.Setenv("MAIL_OUTBOX_DIR", "/tmp/outbox")
+	m, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fm, ok := m.(*FileMailer); !ok || fm.Dir != "/tmp/outbox" || fm.From != "no-reply@shop.local" {
+		t.Errorf("FromEnv() = %#v, want a FileMailer for /tmp/outbox", m)
+	}
+
+	t.Setenv("MAIL_DRIVER", "smtp")
+	t.Setenv("SMTP_HOST", "")
+	if _, err := FromEnv(); err == nil {
+		t.Error("smtp driver without SMTP_HOST accepted")
+	}
+
+	t.Setenv("MAIL_DRIVER", "carrier-pigeon")
+	if _, err := FromEnv(); err == nil {
+		t.Error("unknown driver accepted")
+	}
+}
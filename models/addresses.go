@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// PostalAddress is the part of an address that gets copied into orders.
+type PostalAddress struct {
+	FullName   string `json:"full_name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	City       string `json:"city"`
+	Region     string `json:"region"`
+	PostalCode string `json:"postal_code"`
+	// Country is an ISO 3166-1 alpha-2 code.
+	Country string `json:"country"`
+	Phone   string `json:"phone"`
+}
+
+// Address is an entry in a user's address book.
+type Address struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"-"`
+	Label  string `json:"label"`
+	PostalAddress
+	IsDefaultShipping bool      `json:"is_default_shipping"`
+	IsDefaultBilling  bool      `json:"is_default_billing"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+const addressColumns = `id, user_id, label, full_name, line1, line2, city, region, postal_code, country, phone,
+            is_default_shipping, is_default_billing, created_at, updated_at`
+
+func scanAddress(row pgx.Row, address *Address) error {
+	return row.Scan(&address.ID, &address.UserID, &address.Label, &address.FullName, &address.Line1, &address.Line2,
+		&address.City, &address.Region, &address.PostalCode, &address.Country, &address.Phone,
+		&address.IsDefaultShipping, &address.IsDefaultBilling, &address.CreatedAt, &address.UpdatedAt)
+}
+
+func GetAddressesByUserID(userID int) ([]*Address, error) {
+	query := `
+        SELECT ` + addressColumns + `
+        FROM addresses
+        WHERE user_id = $1
+        ORDER BY id
+    `
+	rows, err := db.Query(context.Background(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addresses []*Address
+	for rows.Next() {
+		var address Address
+		if err := scanAddress(rows, &address); err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, &address)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return addresses, nil
+}
+
+// GetUserAddress returns nil, nil if the address doesn't exist or belongs to
+// someone else.
+func GetUserAddress(userID, addressID int) (*Address, error) {
+	var address Address
+
+	query := `
+        SELECT ` + addressColumns + `
+        FROM addresses
+        WHERE id = $1 AND user_id = $2
+    `
+	err := scanAddress(db.QueryRow(context.Background(), query, addressID, userID), &address)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &address, nil
+}
+
+// clearDefaultAddresses drops the default flags that address is about to
+// take over, so each user keeps at most one default of each kind.
+func clearDefaultAddresses(tx pgx.Tx, address *Address) error {
+	if address.IsDefaultShipping {
+		_, err := tx.Exec(context.Background(), "UPDATE addresses SET is_default_shipping = false WHERE user_id = $1 AND id <> $2 AND is_default_shipping", address.UserID, address.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if address.IsDefaultBilling {
+		_, err := tx.Exec(context.Background(), "UPDATE addresses SET is_default_billing = false WHERE user_id = $1 AND id <> $2 AND is_default_billing", address.UserID, address.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAddress inserts the address. It becomes the default shipping or
+// billing address if the user doesn't have one yet.
+func CreateAddress(address *Address) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var hasShipping, hasBilling bool
+	err = tx.QueryRow(context.Background(), `
+        SELECT COALESCE(bool_or(is_default_shipping), false), COALESCE(bool_or(is_default_billing), false)
+        FROM addresses
+        WHERE user_id = $1
+    `, address.UserID).Scan(&hasShipping, &hasBilling)
+	if err != nil {
+		return err
+	}
+	address.IsDefaultShipping = address.IsDefaultShipping || !hasShipping
+	address.IsDefaultBilling = address.IsDefaultBilling || !hasBilling
+
+	if err := clearDefaultAddresses(tx, address); err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO addresses (user_id, label, full_name, line1, line2, city, region, postal_code, country, phone,
+                               is_default_shipping, is_default_billing)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        RETURNING id, created_at, updated_at
+    `
+	err = tx.QueryRow(context.Background(), query, address.UserID, address.Label, address.FullName, address.Line1,
+		address.Line2, address.City, address.Region, address.PostalCode, address.Country, address.Phone,
+		address.IsDefaultShipping, address.IsDefaultBilling).Scan(&address.ID, &address.CreatedAt, &address.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// UpdateAddress overwrites one of the user's addresses. It returns false if
+// the address doesn't exist or belongs to someone else.
+func UpdateAddress(address *Address) (bool, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	if err := clearDefaultAddresses(tx, address); err != nil {
+		return false, err
+	}
+
+	query := `
+        UPDATE addresses
+        SET label = $1, full_name = $2, line1 = $3, line2 = $4, city = $5, region = $6, postal_code = $7,
+            country = $8, phone = $9, is_default_shipping = $10, is_default_billing = $11, updated_at = now()
+        WHERE id = $12 AND user_id = $13
+        RETURNING created_at, updated_at
+    `
+	err = tx.QueryRow(context.Background(), query, address.Label, address.FullName, address.Line1, address.Line2,
+		address.City, address.Region, address.PostalCode, address.Country, address.Phone,
+		address.IsDefaultShipping, address.IsDefaultBilling, address.ID, address.UserID).Scan(&address.CreatedAt, &address.UpdatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, tx.Commit(context.Background())
+}
+
+func DeleteAddress(userID, addressID int) (bool, error) {
+	tag, err := db.Exec(context.Background(), "DELETE FROM addresses WHERE id = $1 AND user_id = $2", addressID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// Owner fields, filled in by GetAPIKeyByHash.
+	Username string `json:"-"`
+	Role     string `json:"-"`
+}
+
+func CreateAPIKey(key *APIKey) error {
+	query := `
+        INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at
+    `
+	row := db.QueryRow(context.Background(), query, key.UserID, key.Name, key.Prefix, key.KeyHash, key.Scopes, key.ExpiresAt)
+	return row.Scan(&key.ID, &key.CreatedAt)
+}
+
+func GetAPIKeysByUserID(userID int) ([]*APIKey, error) {
+	var keys []*APIKey
+
+	query := `
+        SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, revoked_at, created_at
+        FROM api_keys
+        WHERE user_id = $1
+        ORDER BY created_at DESC
+    `
+	rows, err := db.Query(context.Background(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key APIKey
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Scopes, &key.ExpiresAt, &key.LastUsedAt, &key.RevokedAt, &key.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// GetAPIKeyByHash returns an active (not revoked, not expired) key together
+// with its owner's username and role.
+func GetAPIKeyByHash(keyHash string) (*APIKey, error) {
+	var key APIKey
+
+	query := `
+        SELECT k.id, k.user_id, k.name, k.prefix, k.scopes, k.expires_at, k.last_used_at, k.created_at, u.username, u.role
+        FROM api_keys k
+        JOIN users u ON u.id = k.user_id
+        WHERE k.key_hash = $1
+          AND k.revoked_at IS NULL
+          AND (k.expires_at IS NULL OR k.expires_at > now())
+          AND u.suspended_at IS NULL
+        LIMIT 1
+    `
+	row := db.QueryRow(context.Background(), query, keyHash)
+	err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Scopes, &key.ExpiresAt, &key.LastUsedAt, &key.CreatedAt, &key.Username, &key.Role)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// TouchAPIKey updates last_used_at, at most once a minute per key to keep
+// writes off the hot path.
+func TouchAPIKey(keyID int) error {
+	query := `
+        UPDATE api_keys
+        SET last_used_at = now()
+        WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')
+    `
+	_, err := db.Exec(context.Background(), query, keyID)
+	return err
+}
+
+func RevokeAPIKey(keyID, userID int) (bool, error) {
+	query := `
+        UPDATE api_keys
+        SET revoked_at = now()
+        WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+    `
+	tag, err := db.Exec(context.Background(), query, keyID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+// AuditEvent records who did what to which object. Events are append-only;
+// the database rejects updates and deletes, except for the redaction of
+// personal data when an account is erased.
+type AuditEvent struct {
+	ID            int64                  `json:"id"`
+	ActorID       *int                   `json:"actor_id"`
+	ActorUsername string                 `json:"actor_username"`
+	Action        string                 `json:"action"`
+	TargetType    string                 `json:"target_type"`
+	TargetID      string                 `json:"target_id"`
+	IP            string                 `json:"ip"`
+	Details       map[string]interface{} `json:"details"`
+	// Changes maps each modified field to its old and new value.
+	Changes   map[string]AuditChange `json:"changes"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+type AuditChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// AuditFilter selects audit events. Zero fields don't filter.
+type AuditFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   string
+	IP         string
+	From       time.Time
+	To         time.Time
+}
+
+const auditColumns = "id, actor_id, actor_username, action, target_type, target_id, ip, details, changes, created_at"
+
+func scanAuditEvent(row pgx.Row, event *AuditEvent) error {
+	return row.Scan(&event.ID, &event.ActorID, &event.ActorUsername, &event.Action, &event.TargetType,
+		&event.TargetID, &event.IP, &event.Details, &event.Changes, &event.CreatedAt)
+}
+
+func CreateAuditEvent(event *AuditEvent) error {
+	if event.Details == nil {
+		event.Details = map[string]interface{}{}
+	}
+	if event.Changes == nil {
+		event.Changes = map[string]AuditChange{}
+	}
+
+	query := `
+        INSERT INTO audit_events (actor_id, actor_username, action, target_type, target_id, ip, details, changes)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING id, created_at
+    `
+	row := db.QueryRow(context.Background(), query, event.ActorID, event.ActorUsername, event.Action,
+		event.TargetType, event.TargetID, event.IP, event.Details, event.Changes)
+	return row.Scan(&event.ID, &event.CreatedAt)
+}
+
+// conditions returns the filter as SQL conditions to be joined with AND,
+// with their arguments. The placeholders are numbered from $1, in the order
+// of the arguments.
+func (f AuditFilter) conditions() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, value interface{}) {
+		args = append(args, value)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.ActorID != 0 {
+		add("actor_id = $%d", f.ActorID)
+	}
+	if f.Action != "" {
+		// "user." matches every action on users.
+		if strings.HasSuffix(f.Action, ".") {
+			add("action LIKE $%d", escapeLike(f.Action)+"%")
+		} else {
+			add("action = $%d", f.Action)
+		}
+	}
+	if f.TargetType != "" {
+		add("target_type = $%d", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = $%d", f.TargetID)
+	}
+	if f.IP != "" {
+		add("ip = $%d", f.IP)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at < $%d", f.To)
+	}
+
+	return conditions, args
+}
+
+var auditQueryFields = QuerySchema{
+	"id": {Column: "id", Type: FieldBigInteger, Sortable: true},
+}
+
+// GetAuditEvents returns a page of matching events, newest first unless the
+// page asks for another order.
+func GetAuditEvents(filter AuditFilter, page PageRequest) ([]*AuditEvent, PageInfo, error) {
+	sort := page.Sort
+	if sort == nil {
+		sort = []SortKey{{Field: "id", Desc: true}}
+	}
+	ks, err := newKeyset(auditQueryFields, sort, "id")
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	conditions, args := filter.conditions()
+
+	var events []*AuditEvent
+	info, err := queryPage(ks, auditColumns, "audit_events", conditions, args, page,
+		func(rows pgx.Rows) (map[string]interface{}, error) {
+			var event AuditEvent
+			if err := scanAuditEvent(rows, &event); err != nil {
+				return nil, err
+			}
+			events = append(events, &event)
+			return map[string]interface{}{"id": event.ID}, nil
+		})
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	return events, info, nil
+}
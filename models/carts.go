@@ -6,6 +6,7 @@ type CartItem struct {
 	ID         int       `json:"id"`
 	UserID     int       `json:"user_id"`
 	ProductID  int       `json:"product_id"`
+	VariantID  *int      `json:"variant_id"`
 	Quantity   int       `json:"quantity"`
 	TotalPrice float64   `json:"total_price"`
 	CreatedAt  time.Time `json:"created_at"`
@@ -0,0 +1,297 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+type Category struct {
+	ID        int       `json:"id"`
+	ParentID  *int      `json:"parent_id"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CategoryRef is one step of a breadcrumb path.
+type CategoryRef struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	Slug string `json:"slug"`
+}
+
+// CategoryNode is a category with its subcategories, for the tree view.
+type CategoryNode struct {
+	*Category
+	Children []*CategoryNode `json:"children"`
+}
+
+const categoryColumns = `id, parent_id, name, slug, position, created_at`
+
+func scanCategory(row pgx.Row, category *Category) error {
+	return row.Scan(&category.ID, &category.ParentID, &category.Name, &category.Slug, &category.Position, &category.CreatedAt)
+}
+
+// GetCategories returns every category, siblings ordered by position and
+// name.
+func GetCategories() ([]*Category, error) {
+	query := `
+        SELECT ` + categoryColumns + `
+        FROM categories
+        ORDER BY position, name, id
+    `
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var categories []*Category
+	for rows.Next() {
+		var category Category
+		if err := scanCategory(rows, &category); err != nil {
+			return nil, err
+		}
+		categories = append(categories, &category)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return categories, nil
+}
+
+// BuildCategoryTree nests the categories under their parents and returns
+// the roots. Order among siblings is kept.
+func BuildCategoryTree(categories []*Category) []*CategoryNode {
+	nodes := make(map[int]*CategoryNode, len(categories))
+	for _, category := range categories {
+		nodes[category.ID] = &CategoryNode{Category: category, Children: []*CategoryNode{}}
+	}
+
+	roots := []*CategoryNode{}
+	for _, category := range categories {
+		node := nodes[category.ID]
+		if category.ParentID != nil {
+			if parent, ok := nodes[*category.ParentID]; ok {
+				parent.Children = append(parent.Children, node)
+				continue
+			}
+		}
+		roots = append(roots, node)
+	}
+	return roots
+}
+
+func GetCategoryByID(id int) (*Category, error) {
+	var category Category
+
+	query := `
+        SELECT ` + categoryColumns + `
+        FROM categories
+        WHERE id = $1
+    `
+	err := scanCategory(db.QueryRow(context.Background(), query, id), &category)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &category, nil
+}
+
+// GetCategoryPath returns the breadcrumb from the root down to the category
+// itself.
+func GetCategoryPath(id int) ([]CategoryRef, error) {
+	query := `
+        WITH RECURSIVE path AS (
+            SELECT id, parent_id, name, slug, 0 AS depth
+            FROM categories
+            WHERE id = $1
+            UNION ALL
+            SELECT c.id, c.parent_id, c.name, c.slug, path.depth + 1
+            FROM categories c
+            JOIN path ON c.id = path.parent_id
+        )
+        SELECT id, name, slug
+        FROM path
+        ORDER BY depth DESC
+    `
+	rows, err := db.Query(context.Background(), query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	path := []CategoryRef{}
+	for rows.Next() {
+		var ref CategoryRef
+		if err := rows.Scan(&ref.ID, &ref.Name, &ref.Slug); err != nil {
+			return nil, err
+		}
+		path = append(path, ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return path, nil
+}
+
+// IsCategoryInSubtree reports whether id is root or one of its descendants.
+func IsCategoryInSubtree(root, id int) (bool, error) {
+	var found bool
+	err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM category_subtree($1) AS s(id) WHERE s.id = $2)", root, id).Scan(&found)
+	return found, err
+}
+
+func CreateCategory(category *Category) error {
+	query := `
+        INSERT INTO categories (parent_id, name, slug, position)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at
+    `
+	return db.QueryRow(context.Background(), query, category.ParentID, category.Name, category.Slug, category.Position).
+		Scan(&category.ID, &category.CreatedAt)
+}
+
+// UpdateCategory returns false if the category doesn't exist. Callers must
+// make sure the new parent isn't inside the category's own subtree.
+func UpdateCategory(category *Category) (bool, error) {
+	query := `
+        UPDATE categories
+        SET parent_id = $1, name = $2, slug = $3, position = $4
+        WHERE id = $5
+        RETURNING created_at
+    `
+	err := db.QueryRow(context.Background(), query, category.ParentID, category.Name, category.Slug, category.Position, category.ID).
+		Scan(&category.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+func CountChildCategories(id int) (int, error) {
+	var count int
+	err := db.QueryRow(context.Background(), "SELECT count(*) FROM categories WHERE parent_id = $1", id).Scan(&count)
+	return count, err
+}
+
+// DeleteCategory removes the category and its product assignments. The
+// database refuses it while the category has children.
+func DeleteCategory(id int) (bool, error) {
+	tag, err := db.Exec(context.Background(), "DELETE FROM categories WHERE id = $1", id)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// GetMissingCategoryIDs returns the IDs among ids that don't exist.
+func GetMissingCategoryIDs(ids []int) ([]int, error) {
+	query := `
+        SELECT requested.id
+        FROM unnest($1::int[]) AS requested(id)
+        WHERE NOT EXISTS (SELECT 1 FROM categories c WHERE c.id = requested.id)
+    `
+	rows, err := db.Query(context.Background(), query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var missing []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		missing = append(missing, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return missing, nil
+}
+
+// SetProductCategories replaces the product's categories.
+func SetProductCategories(productID int, categoryIDs []int) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM product_categories WHERE product_id = $1", productID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), `
+        INSERT INTO product_categories (product_id, category_id)
+        SELECT $1, id FROM unnest($2::int[]) AS ids(id)
+        ON CONFLICT DO NOTHING
+    `, productID, categoryIDs)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// GetProductBreadcrumbs returns, for each of the products, one breadcrumb
+// path per category the product is in, each from the root down.
+func GetProductBreadcrumbs(productIDs []int) (map[int][][]CategoryRef, error) {
+	query := `
+        WITH RECURSIVE path AS (
+            SELECT pc.product_id, pc.category_id AS leaf_id, c.id, c.parent_id, c.name, c.slug, 0 AS depth
+            FROM product_categories pc
+            JOIN categories c ON c.id = pc.category_id
+            WHERE pc.product_id = ANY($1)
+            UNION ALL
+            SELECT path.product_id, path.leaf_id, c.id, c.parent_id, c.name, c.slug, path.depth + 1
+            FROM categories c
+            JOIN path ON c.id = path.parent_id
+        )
+        SELECT product_id, leaf_id, id, name, slug
+        FROM path
+        ORDER BY product_id, leaf_id, depth DESC
+    `
+	rows, err := db.Query(context.Background(), query, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breadcrumbs := make(map[int][][]CategoryRef)
+	lastProductID, lastLeafID := 0, 0
+	for rows.Next() {
+		var productID, leafID int
+		var ref CategoryRef
+		if err := rows.Scan(&productID, &leafID, &ref.ID, &ref.Name, &ref.Slug); err != nil {
+			return nil, err
+		}
+		paths := breadcrumbs[productID]
+		if productID != lastProductID || leafID != lastLeafID {
+			paths = append(paths, nil)
+			lastProductID, lastLeafID = productID, leafID
+		}
+		paths[len(paths)-1] = append(paths[len(paths)-1], ref)
+		breadcrumbs[productID] = paths
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return breadcrumbs, nil
+}
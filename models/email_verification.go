@@ -0,0 +1,107 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+type EmailVerificationToken struct {
+	ID        int
+	UserID    int
+	Email     string
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// CreateEmailVerificationToken stores a new token and invalidates any
+// earlier unused ones for the same user, so only the latest link works.
+func CreateEmailVerificationToken(token *EmailVerificationToken) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), `
+        UPDATE email_verification_tokens
+        SET used_at = now()
+        WHERE user_id = $1 AND used_at IS NULL
+    `, token.UserID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO email_verification_tokens (user_id, email, token_hash, expires_at)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at
+    `
+	row := tx.QueryRow(context.Background(), query, token.UserID, token.Email, token.TokenHash, token.ExpiresAt)
+	err = row.Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func GetEmailVerificationTokenByHash(tokenHash string) (*EmailVerificationToken, error) {
+	var token EmailVerificationToken
+
+	query := `
+        SELECT id, user_id, email, token_hash, expires_at, used_at, created_at
+        FROM email_verification_tokens
+        WHERE token_hash = $1
+        LIMIT 1
+    `
+	row := db.QueryRow(context.Background(), query, tokenHash)
+	err := row.Scan(&token.ID, &token.UserID, &token.Email, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// ConsumeEmailVerificationToken marks the token used and the user's email
+// verified, provided the token is still unused and the user hasn't changed
+// their email since it was issued.
+func ConsumeEmailVerificationToken(token *EmailVerificationToken) (bool, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	tag, err := tx.Exec(context.Background(), `
+        UPDATE email_verification_tokens
+        SET used_at = now()
+        WHERE id = $1 AND used_at IS NULL
+    `, token.ID)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() != 1 {
+		return false, nil
+	}
+
+	tag, err = tx.Exec(context.Background(), `
+        UPDATE users
+        SET email_verified_at = now()
+        WHERE id = $1 AND email = $2
+    `, token.UserID, token.Email)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() != 1 {
+		return false, nil
+	}
+
+	return true, tx.Commit(context.Background())
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ScheduleUserErasure marks the account for anonymization at the given time.
+// An erasure that is already pending keeps its original date.
+func ScheduleUserErasure(userID int, at time.Time) (time.Time, error) {
+	query := `
+        UPDATE users
+        SET erasure_scheduled_at = COALESCE(erasure_scheduled_at, $1)
+        WHERE id = $2 AND anonymized_at IS NULL
+        RETURNING erasure_scheduled_at
+    `
+	var scheduledAt time.Time
+	err := db.QueryRow(context.Background(), query, at, userID).Scan(&scheduledAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to schedule erasure: %v", err)
+	}
+
+	return scheduledAt, nil
+}
+
+// CancelUserErasure returns false if no erasure was pending.
+func CancelUserErasure(userID int) (bool, error) {
+	query := `
+        UPDATE users
+        SET erasure_scheduled_at = NULL
+        WHERE id = $1 AND erasure_scheduled_at IS NOT NULL AND anonymized_at IS NULL
+    `
+	tag, err := db.Exec(context.Background(), query, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// GetUserIDsDueForErasure returns accounts whose grace period has ended.
+func GetUserIDsDueForErasure(limit int) ([]int, error) {
+	query := `
+        SELECT id
+        FROM users
+        WHERE erasure_scheduled_at <= now() AND anonymized_at IS NULL
+        ORDER BY erasure_scheduled_at
+        LIMIT $1
+    `
+	rows, err := db.Query(context.Background(), query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return userIDs, nil
+}
+
+// AnonymizeUser removes the personal data of an account in one transaction.
+// The users row itself is kept, scrubbed, so that orders still point to a
+// customer and remain usable for accounting. Audit events about the user are
+// redacted but kept. Order address snapshots are scrubbed too: the shipping
+// address is dropped and the billing address is cut down to its country,
+// which tax reporting still needs. Products that appear in orders are kept
+// out of stock; all others are deleted. The placeholder username and email
+// contain a colon, which registration and profile updates never accept, so
+// nobody can claim them ahead of time and make the erasure fail.
+func AnonymizeUser(userID int) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	statements := []string{
+		// Before the username is overwritten: the redaction matches on it.
+		"SELECT redact_audit_events($1, (SELECT username FROM users WHERE id = $1))",
+		"DELETE FROM login_lockouts WHERE username = (SELECT username FROM users WHERE id = $1)",
+		"DELETE FROM cart_items WHERE user_id = $1",
+		"DELETE FROM addresses WHERE user_id = $1",
+		`UPDATE orders
+         SET shipping_address = NULL,
+             billing_address = CASE WHEN billing_address IS NULL THEN NULL
+                                    ELSE jsonb_build_object('country', billing_address->'country') END
+         WHERE user_id = $1`,
+		"DELETE FROM token_families WHERE user_id = $1",
+		"DELETE FROM api_keys WHERE user_id = $1",
+		"DELETE FROM user_identities WHERE user_id = $1",
+		"DELETE FROM recovery_codes WHERE user_id = $1",
+		"DELETE FROM email_verification_tokens WHERE user_id = $1",
+		"DELETE FROM password_reset_tokens WHERE user_id = $1",
+		"DELETE FROM products WHERE owner_id = $1 AND NOT EXISTS (SELECT 1 FROM order_items WHERE order_items.product_id = products.id)",
+		"UPDATE products SET stock_quantity = 0 WHERE owner_id = $1",
+		"UPDATE product_variants SET stock_quantity = 0 WHERE product_id IN (SELECT id FROM products WHERE owner_id = $1)",
+		`UPDATE users
+         SET username = 'deleted:' || id,
+             email = 'deleted:' || id || '@deleted.invalid',
+             password = '',
+             email_verified_at = NULL,
+             totp_secret = NULL,
+             totp_enabled_at = NULL,
+             totp_last_step = 0,
+             erasure_scheduled_at = NULL,
+             anonymized_at = now()
+         WHERE id = $1`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(context.Background(), statement, userID); err != nil {
+			return fmt.Errorf("failed to anonymize user %d: %v", userID, err)
+		}
+	}
+
+	return tx.Commit(context.Background())
+}
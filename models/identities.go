@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// UserIdentity links a local user to an account at an external OpenID
+// Connect provider.
+type UserIdentity struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OIDCState is the server-side half of an authorization request: the state
+// parameter, the nonce expected in the ID token and the PKCE verifier.
+type OIDCState struct {
+	State        string
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	LinkUserID   *int
+	ExpiresAt    time.Time
+}
+
+func GetUserIdentity(provider, subject string) (*UserIdentity, error) {
+	var identity UserIdentity
+
+	query := `
+        SELECT id, user_id, provider, subject, email, created_at
+        FROM user_identities
+        WHERE provider = $1 AND subject = $2
+        LIMIT 1
+    `
+	row := db.QueryRow(context.Background(), query, provider, subject)
+	err := row.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+func CreateUserIdentity(identity *UserIdentity) error {
+	query := `
+        INSERT INTO user_identities (user_id, provider, subject, email)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at
+    `
+	row := db.QueryRow(context.Background(), query, identity.UserID, identity.Provider, identity.Subject, identity.Email)
+	return row.Scan(&identity.ID, &identity.CreatedAt)
+}
+
+// CreateUserWithIdentity creates a local account for a first-time external
+// login. The email is marked verified when the provider vouches for it.
+func CreateUserWithIdentity(user *User, identity *UserIdentity, emailVerified bool) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	if user.Role == "" {
+		user.Role = RoleCustomer
+	}
+	query := `
+        INSERT INTO users (username, password, email, role, email_verified_at)
+        VALUES ($1, $2, $3, $4, CASE WHEN $5 THEN now() END)
+        RETURNING ` + userColumns
+	row := tx.QueryRow(context.Background(), query, user.Username, user.Password, user.Email, user.Role, emailVerified)
+	if err := scanUser(row, user); err != nil {
+		return err
+	}
+
+	identity.UserID = user.ID
+	row = tx.QueryRow(context.Background(), `
+        INSERT INTO user_identities (user_id, provider, subject, email)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at
+    `, identity.UserID, identity.Provider, identity.Subject, identity.Email)
+	if err := row.Scan(&identity.ID, &identity.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func UsernameExists(username string) (bool, error) {
+	var exists bool
+
+	query := `SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)`
+	err := db.QueryRow(context.Background(), query, username).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+func CreateOIDCState(state *OIDCState) error {
+	_, err := db.Exec(context.Background(), "DELETE FROM oidc_states WHERE expires_at < now()")
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO oidc_states (state, provider, nonce, code_verifier, link_user_id, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `
+	_, err = db.Exec(context.Background(), query, state.State, state.Provider, state.Nonce, state.CodeVerifier, state.LinkUserID, state.ExpiresAt)
+	return err
+}
+
+// ConsumeOIDCState deletes and returns an unexpired state, so every state
+// value can complete at most one login.
+func ConsumeOIDCState(state, provider string) (*OIDCState, error) {
+	var s OIDCState
+
+	query := `
+        DELETE FROM oidc_states
+        WHERE state = $1 AND provider = $2 AND expires_at > now()
+        RETURNING state, provider, nonce, code_verifier, link_user_id, expires_at
+    `
+	row := db.QueryRow(context.Background(), query, state, provider)
+	err := row.Scan(&s.State, &s.Provider, &s.Nonce, &s.CodeVerifier, &s.LinkUserID, &s.ExpiresAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &s, nil
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+type LoginLockout struct {
+	ID          int       `json:"id"`
+	Key         string    `json:"key"`
+	Username    string    `json:"username"`
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"locked_until"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func GetLoginLockedUntil(key string) (time.Time, error) {
+	var lockedUntil *time.Time
+
+	query := `SELECT locked_until FROM login_attempts WHERE key = $1`
+	err := db.QueryRow(context.Background(), query, key).Scan(&lockedUntil)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if lockedUntil == nil {
+		return time.Time{}, nil
+	}
+
+	return *lockedUntil, nil
+}
+
+// RecordLoginFailure increments the consecutive failure counter for key and
+// returns the new value. Failures older than window no longer count.
+func RecordLoginFailure(key string, window time.Duration) (int, error) {
+	var failures int
+
+	query := `
+        INSERT INTO login_attempts (key, failures, last_failure_at)
+        VALUES ($1, 1, now())
+        ON CONFLICT (key) DO UPDATE
+        SET failures = CASE
+                WHEN login_attempts.last_failure_at < now() - make_interval(secs => $2) THEN 1
+                ELSE login_attempts.failures + 1
+            END,
+            last_failure_at = now()
+        RETURNING failures
+    `
+	err := db.QueryRow(context.Background(), query, key, window.Seconds()).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	return failures, nil
+}
+
+func LockLogin(key string, until time.Time) error {
+	query := `UPDATE login_attempts SET locked_until = $2 WHERE key = $1`
+	_, err := db.Exec(context.Background(), query, key, until)
+	return err
+}
+
+func ResetLoginAttempts(key string) error {
+	query := `DELETE FROM login_attempts WHERE key = $1`
+	_, err := db.Exec(context.Background(), query, key)
+	return err
+}
+
+func CreateLoginLockout(lockout *LoginLockout) error {
+	query := `
+        INSERT INTO login_lockouts (key, username, ip, failures, locked_until)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at
+    `
+	row := db.QueryRow(context.Background(), query, lockout.Key, lockout.Username, lockout.IP, lockout.Failures, lockout.LockedUntil)
+	return row.Scan(&lockout.ID, &lockout.CreatedAt)
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrate applies every migrations/*.sql file that hasn't been recorded in
+// schema_migrations yet, in file name order.
+func Migrate() error {
+	_, err := db.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            name TEXT PRIMARY KEY,
+            applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var applied bool
+		err := db.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE name = $1)", name).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		script, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+
+		tx, err := db.Begin(context.Background())
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(context.Background(), string(script)); err != nil {
+			tx.Rollback(context.Background())
+			return fmt.Errorf("migration %s: %v", name, err)
+		}
+		if _, err := tx.Exec(context.Background(), "INSERT INTO schema_migrations (name) VALUES ($1)", name); err != nil {
+			tx.Rollback(context.Background())
+			return err
+		}
+		if err := tx.Commit(context.Background()); err != nil {
+			return err
+		}
+		log.Println("Applied migration", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+CREATE TABLE IF NOT EXISTS roles (
+    name TEXT PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+    role TEXT NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+    permission TEXT NOT NULL,
+    PRIMARY KEY (role, permission)
+);
+
+INSERT INTO roles (name) VALUES ('customer'), ('seller'), ('admin')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO role_permissions (role, permission) VALUES
+    ('customer', 'profile:read'),
+    ('customer', 'profile:write'),
+    ('customer', 'cart:read'),
+    ('customer', 'cart:write'),
+    ('customer', 'orders:read'),
+    ('customer', 'orders:write'),
+    ('customer', 'products:read'),
+
+    ('seller', 'profile:read'),
+    ('seller', 'profile:write'),
+    ('seller', 'cart:read'),
+    ('seller', 'cart:write'),
+    ('seller', 'orders:read'),
+    ('seller', 'orders:write'),
+    ('seller', 'products:read'),
+    ('seller', 'products:write'),
+
+    ('admin', 'profile:read'),
+    ('admin', 'profile:write'),
+    ('admin', 'cart:read'),
+    ('admin', 'cart:write'),
+    ('admin', 'orders:read'),
+    ('admin', 'orders:write'),
+    ('admin', 'orders:manage'),
+    ('admin', 'products:read'),
+    ('admin', 'products:write'),
+    ('admin', 'products:manage'),
+    ('admin', 'users:manage')
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'customer' REFERENCES roles (name);
+
+-- Everyone who already sells something keeps being able to manage it.
+UPDATE users SET role = 'seller'
+WHERE role = 'customer' AND id IN (SELECT owner_id FROM products);
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS erasure_scheduled_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS anonymized_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS users_erasure_scheduled_at_idx ON users (erasure_scheduled_at) WHERE erasure_scheduled_at IS NOT NULL;
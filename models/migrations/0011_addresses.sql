@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS addresses (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    label TEXT NOT NULL DEFAULT '',
+    full_name TEXT NOT NULL,
+    line1 TEXT NOT NULL,
+    line2 TEXT NOT NULL DEFAULT '',
+    city TEXT NOT NULL,
+    region TEXT NOT NULL DEFAULT '',
+    postal_code TEXT NOT NULL DEFAULT '',
+    country TEXT NOT NULL,
+    phone TEXT NOT NULL DEFAULT '',
+    is_default_shipping BOOLEAN NOT NULL DEFAULT false,
+    is_default_billing BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS addresses_user_id_idx ON addresses (user_id);
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_default_shipping_idx ON addresses (user_id) WHERE is_default_shipping;
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_default_billing_idx ON addresses (user_id) WHERE is_default_billing;
+
+-- Orders keep a copy of the addresses as they were at checkout.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_address JSONB;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS billing_address JSONB;
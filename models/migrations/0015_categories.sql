@@ -0,0 +1,34 @@
+CREATE TABLE IF NOT EXISTS categories (
+    id SERIAL PRIMARY KEY,
+    -- Categories with children can't be deleted; move or delete the children first.
+    parent_id INTEGER REFERENCES categories (id) ON DELETE RESTRICT,
+    name TEXT NOT NULL,
+    slug TEXT NOT NULL UNIQUE,
+    -- Order among siblings.
+    position INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (parent_id <> id)
+);
+
+CREATE INDEX IF NOT EXISTS categories_parent_id_idx ON categories (parent_id, position);
+
+CREATE TABLE IF NOT EXISTS product_categories (
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    category_id INTEGER NOT NULL REFERENCES categories (id) ON DELETE CASCADE,
+    PRIMARY KEY (product_id, category_id)
+);
+
+CREATE INDEX IF NOT EXISTS product_categories_category_id_idx ON product_categories (category_id);
+
+-- The IDs of a category and all of its descendants.
+CREATE OR REPLACE FUNCTION category_subtree(root INTEGER) RETURNS SETOF INTEGER AS $$
+    WITH RECURSIVE subtree AS (
+        SELECT id FROM categories WHERE id = root
+        UNION
+        SELECT c.id FROM categories c JOIN subtree s ON c.parent_id = s.id
+    )
+    SELECT id FROM subtree
+$$ LANGUAGE sql STABLE;
+
+INSERT INTO role_permissions (role, permission) VALUES ('admin', 'categories:manage')
+ON CONFLICT DO NOTHING;
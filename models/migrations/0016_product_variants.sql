@@ -0,0 +1,28 @@
+-- Options a product comes in, e.g. size with values S, M, L.
+CREATE TABLE IF NOT EXISTS product_options (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    option_values TEXT[] NOT NULL,
+    position INTEGER NOT NULL DEFAULT 0,
+    UNIQUE (product_id, name)
+);
+
+-- One sellable combination of option values. A NULL price means the
+-- product's price.
+CREATE TABLE IF NOT EXISTS product_variants (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products (id) ON DELETE CASCADE,
+    sku TEXT NOT NULL UNIQUE,
+    options JSONB NOT NULL,
+    price NUMERIC(12, 2) CHECK (price > 0),
+    stock_quantity INTEGER NOT NULL DEFAULT 0 CHECK (stock_quantity >= 0),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (product_id, options)
+);
+
+ALTER TABLE cart_items ADD COLUMN IF NOT EXISTS variant_id INTEGER REFERENCES product_variants (id) ON DELETE CASCADE;
+
+-- Order items keep the SKU in case the variant is deleted later.
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS variant_id INTEGER REFERENCES product_variants (id) ON DELETE SET NULL;
+ALTER TABLE order_items ADD COLUMN IF NOT EXISTS sku TEXT NOT NULL DEFAULT '';
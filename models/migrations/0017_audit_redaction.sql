@@ -0,0 +1,45 @@
+-- Account erasure has to remove personal data from the audit log too. The
+-- log stays append-only, with one exception: an UPDATE that only blanks the
+-- actor's name or the IP, or only removes entries from details and changes,
+-- is a redaction and is let through. Events can't be deleted, and who did
+-- what to which object can't be rewritten.
+CREATE OR REPLACE FUNCTION audit_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' THEN
+        IF NEW.id = OLD.id
+           AND NEW.actor_id IS NOT DISTINCT FROM OLD.actor_id
+           AND NEW.action = OLD.action
+           AND NEW.target_type = OLD.target_type
+           AND NEW.target_id = OLD.target_id
+           AND NEW.created_at = OLD.created_at
+           AND NEW.actor_username IN (OLD.actor_username, '')
+           AND NEW.ip IN (OLD.ip, '')
+           AND OLD.details @> NEW.details
+           AND OLD.changes @> NEW.changes THEN
+            RETURN NEW;
+        END IF;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+-- redact_audit_events scrubs the personal data of one user from the log:
+-- their name and IP on events they performed, the IP of login failures and
+-- lockouts under their username, attempted usernames and lockout keys, and
+-- the values of username and email changes. Which fields changed is kept.
+-- It runs with its owner's rights, so the application role doesn't need
+-- UPDATE on audit_events.
+CREATE OR REPLACE FUNCTION redact_audit_events(p_user_id INTEGER, p_username TEXT) RETURNS void AS $$
+    UPDATE audit_events
+    SET actor_username = CASE WHEN actor_id = p_user_id THEN '' ELSE actor_username END,
+        ip = CASE WHEN actor_id = p_user_id OR actor_id IS NULL THEN '' ELSE ip END,
+        details = details - 'username' - 'key',
+        changes = (changes - 'username' - 'email') || (
+            SELECT COALESCE(jsonb_object_agg(field, '{}'::jsonb), '{}'::jsonb)
+            FROM jsonb_object_keys(changes) AS field
+            WHERE field IN ('username', 'email')
+        )
+    WHERE actor_id = p_user_id
+       OR (target_type = 'user' AND target_id = p_user_id::text)
+       OR details->>'username' = p_username;
+$$ LANGUAGE sql SECURITY DEFINER SET search_path = public;
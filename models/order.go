@@ -8,12 +8,19 @@ type Order struct {
 	TotalAmount float64
 	Status      string
 	CreatedAt   time.Time
+	// Addresses are copied from the address book at checkout, so editing or
+	// deleting an address later doesn't change past orders.
+	ShippingAddress *PostalAddress
+	BillingAddress  *PostalAddress
 }
 
 type OrderItem struct {
-	ID        int     `json:"id"`
-	OrderID   int     `json:"order_id"`
-	ProductID int     `json:"product_id"`
+	ID        int  `json:"id"`
+	OrderID   int  `json:"order_id"`
+	ProductID int  `json:"product_id"`
+	VariantID *int `json:"variant_id"`
+	// SKU is copied from the variant when the order is placed.
+	SKU       string  `json:"sku,omitempty"`
 	Quantity  int     `json:"quantity"`
 	Price     float64 `json:"price"`
 	CreatedAt string  `json:"created_at"`
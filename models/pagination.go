@@ -0,0 +1,207 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"time"
+)
+
+// Lists are paginated by keyset: a page starts right after the sort key
+// values of the last row of the previous page, which the client gets back as
+// an opaque cursor. Unlike OFFSET this stays fast on deep pages and doesn't
+// skip or repeat rows when rows are inserted or deleted between requests.
+
+const (
+	DefaultPageSize = 20
+	MaxPageSize     = 100
+)
+
+// PageRequest asks for one page of a list.
+type PageRequest struct {
+	Sort   []SortKey
+	Cursor string
+	Limit  int
+	// WithTotal also counts every matching row, which costs a second query.
+	WithTotal bool
+}
+
+type PageInfo struct {
+	// NextCursor is empty on the last page.
+	NextCursor string
+	Total      *int
+}
+
+// keyset is a sort order made total by a unique tiebreak field.
+type keyset struct {
+	schema QuerySchema
+	keys   []SortKey
+}
+
+func newKeyset(schema QuerySchema, sort []SortKey, tiebreak string) (*keyset, error) {
+	keys := make([]SortKey, 0, len(sort)+1)
+	hasTiebreak := false
+	for _, key := range sort {
+		field, ok := schema[key.Field]
+		if !ok || !field.Sortable {
+			return nil, &QueryError{Clause: "sort", Rule: "field", Message: fmt.Sprintf("cannot sort by %q, allowed: %s", key.Field, schema.fieldNames(true))}
+		}
+		keys = append(keys, key)
+		hasTiebreak = hasTiebreak || key.Field == tiebreak
+	}
+	if !hasTiebreak {
+		keys = append(keys, SortKey{Field: tiebreak})
+	}
+	return &keyset{schema: schema, keys: keys}, nil
+}
+
+func (k *keyset) orderBy() string {
+	columns := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		direction := "ASC"
+		if key.Desc {
+			direction = "DESC"
+		}
+		columns[i] = k.schema[key.Field].Column + " " + direction
+	}
+	return strings.Join(columns, ", ")
+}
+
+// signature names the sort order, so a cursor can't be replayed against a
+// different one.
+func (k *keyset) signature() string {
+	fields := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		fields[i] = key.Field
+		if key.Desc {
+			fields[i] = "-" + key.Field
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+type pageCursor struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+}
+
+// encodeCursor makes the cursor for the page after the row with the given
+// field values.
+func (k *keyset) encodeCursor(values map[string]interface{}) string {
+	cursor := pageCursor{Sort: k.signature()}
+	for _, key := range k.keys {
+		value := values[key.Field]
+		if t, ok := value.(time.Time); ok {
+			value = t.Format(time.RFC3339Nano)
+		}
+		cursor.Values = append(cursor.Values, value)
+	}
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// after decodes the cursor into the condition that selects the rows
+// following it, e.g. (a > $1) OR (a = $1 AND b < $2), and appends the
+// cursor values to args.
+func (k *keyset) after(cursor string, args *[]interface{}) (string, error) {
+	invalid := &QueryError{Clause: "cursor", Rule: "cursor", Message: "is invalid or was issued for a different sort order"}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", invalid
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var decoded pageCursor
+	if err := decoder.Decode(&decoded); err != nil || decoded.Sort != k.signature() || len(decoded.Values) != len(k.keys) {
+		return "", invalid
+	}
+
+	placeholders := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		value, err := parseFilterValue(k.schema[key.Field].Type, fmt.Sprint(decoded.Values[i]))
+		if err != nil {
+			return "", invalid
+		}
+		*args = append(*args, value)
+		placeholders[i] = fmt.Sprintf("$%d", len(*args))
+	}
+
+	alternatives := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, k.schema[k.keys[j].Field].Column+" = "+placeholders[j])
+		}
+		operator := ">"
+		if key.Desc {
+			operator = "<"
+		}
+		parts = append(parts, k.schema[key.Field].Column+" "+operator+" "+placeholders[i])
+		alternatives[i] = "(" + strings.Join(parts, " AND ") + ")"
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", nil
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// queryPage runs a paginated SELECT of columns from from, filtered by
+// conditions whose parameters are in args. scan is called for each row of
+// the page and returns the row's values by schema field name, from which the
+// next cursor is built.
+func queryPage(ks *keyset, columns, from string, conditions []string, args []interface{}, page PageRequest, scan func(pgx.Rows) (map[string]interface{}, error)) (PageInfo, error) {
+	var info PageInfo
+
+	if page.WithTotal {
+		var total int
+		err := db.QueryRow(context.Background(), "SELECT count(*) FROM "+from+whereClause(conditions), args...).Scan(&total)
+		if err != nil {
+			return info, err
+		}
+		info.Total = &total
+	}
+
+	if page.Cursor != "" {
+		condition, err := ks.after(page.Cursor, &args)
+		if err != nil {
+			return info, err
+		}
+		conditions = append(conditions, condition)
+	}
+
+	// One row more than asked tells whether there is a next page.
+	args = append(args, page.Limit+1)
+	query := "SELECT " + columns + " FROM " + from + whereClause(conditions) +
+		" ORDER BY " + ks.orderBy() + fmt.Sprintf(" LIMIT $%d", len(args))
+
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return info, err
+	}
+	defer rows.Close()
+
+	var last map[string]interface{}
+	for count := 0; rows.Next(); count++ {
+		if count == page.Limit {
+			info.NextCursor = ks.encodeCursor(last)
+			break
+		}
+		if last, err = scan(rows); err != nil {
+			return info, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
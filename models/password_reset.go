@@ -0,0 +1,104 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+type PasswordResetToken struct {
+	ID        int
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// CreatePasswordResetToken stores a new token and invalidates any earlier
+// unused ones for the same user.
+func CreatePasswordResetToken(token *PasswordResetToken) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), `
+        UPDATE password_reset_tokens
+        SET used_at = now()
+        WHERE user_id = $1 AND used_at IS NULL
+    `, token.UserID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+        INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+        VALUES ($1, $2, $3)
+        RETURNING id, created_at
+    `
+	row := tx.QueryRow(context.Background(), query, token.UserID, token.TokenHash, token.ExpiresAt)
+	err = row.Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// revokeUserCredentials revokes every session and API key of the user, so a
+// password reset also locks out whoever the reset is meant to keep out.
+func revokeUserCredentials(tx pgx.Tx, userID int) error {
+	_, err := tx.Exec(context.Background(), `
+        UPDATE token_families
+        SET revoked_at = now()
+        WHERE user_id = $1 AND revoked_at IS NULL
+    `, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), `
+        UPDATE api_keys
+        SET revoked_at = now()
+        WHERE user_id = $1 AND revoked_at IS NULL
+    `, userID)
+	return err
+}
+
+// ResetPassword consumes an unused, unexpired reset token, stores the new
+// password hash and revokes every session and API key of the user. It
+// returns the user's ID, or 0 if the token is unknown, used or expired.
+func ResetPassword(tokenHash, passwordHash string) (int, error) {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var userID int
+	err = tx.QueryRow(context.Background(), `
+        UPDATE password_reset_tokens
+        SET used_at = now()
+        WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+        RETURNING user_id
+    `, tokenHash).Scan(&userID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE users SET password = $1 WHERE id = $2", passwordHash, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := revokeUserCredentials(tx, userID); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit(context.Background())
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"github.com/jackc/pgx/v4"
+	"strings"
+	"unicode"
+)
+
+// maxSearchTerms bounds the size of the generated tsquery.
+const maxSearchTerms = 10
+
+// The highlight options wrap matches in <mark>. The text is HTML-escaped
+// before highlighting, so the snippets are safe to render as HTML. They are
+// spliced into the SQL as literals and must not contain single quotes.
+const (
+	searchNameHighlightOptions = "StartSel=<mark>, StopSel=</mark>, HighlightAll=true"
+	searchSnippetOptions       = "StartSel=<mark>, StopSel=</mark>, MaxFragments=2, MaxWords=30, MinWords=10, FragmentDelimiter=\" … \""
+)
+
+type ProductSearchResult struct {
+	*Product
+	Rank float64 `json:"rank"`
+	// NameHighlight and Snippet are HTML with the matched words in <mark>.
+	NameHighlight string `json:"name_highlight"`
+	Snippet       string `json:"snippet"`
+}
+
+// SearchQuery turns free text into a tsquery that matches documents
+// containing every word, each as a prefix, e.g. "red shirt" becomes
+// "red:* & shirt:*". Only letters and digits are kept, so the result is
+// always valid tsquery syntax. It returns "" if q has no words.
+func SearchQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+	for i, word := range words {
+		words[i] = strings.ToLower(word) + ":*"
+	}
+	return strings.Join(words, " & ")
+}
+
+// escapeHTMLSQL is the SQL for HTML-escaping a text column.
+func escapeHTMLSQL(column string) string {
+	return "replace(replace(replace(" + column + ", '&', '&amp;'), '<', '&lt;'), '>', '&gt;')"
+}
+
+// searchQueryFields order search results by relevance; the columns refer
+// to the FROM clause of SearchProducts. ts_rank returns a real; it is
+// widened to float8 in both the select list and the cursor condition, so a
+// rank read back from a cursor compares equal to the row it came from.
+var searchQueryFields = QuerySchema{
+	"rank": {Column: "ts_rank(p.search_vector, q.query)::float8", Type: FieldNumber, Sortable: true},
+	"id":   {Column: "p.id", Type: FieldInteger, Sortable: true},
+}
+
+// SearchProducts returns a page of the products matching tsquery, best
+// matches first. tsquery should come from SearchQuery.
+func SearchProducts(tsquery string, page PageRequest) ([]*ProductSearchResult, PageInfo, error) {
+	ks, err := newKeyset(searchQueryFields, []SortKey{{Field: "rank", Desc: true}}, "id")
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	columns := `p.id, p.name, p.description, p.price, p.stock_quantity, p.created_at, p.owner_id,
+               ts_rank(p.search_vector, q.query)::float8,
+               ts_headline('english', ` + escapeHTMLSQL("p.name") + `, q.query, '` + searchNameHighlightOptions + `'),
+               ts_headline('english', ` + escapeHTMLSQL("p.description") + `, q.query, '` + searchSnippetOptions + `')`
+	from := "products p, to_tsquery('english', $1) AS q(query)"
+
+	var results []*ProductSearchResult
+	info, err := queryPage(ks, columns, from, []string{"p.search_vector @@ q.query"}, []interface{}{tsquery}, page,
+		func(rows pgx.Rows) (map[string]interface{}, error) {
+			result := &ProductSearchResult{Product: &Product{}}
+			err := rows.Scan(&result.ID, &result.Name, &result.Description, &result.Price, &result.StockQuantity, &result.CreatedAt, &result.OwnerID,
+				&result.Rank, &result.NameHighlight, &result.Snippet)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result)
+			return map[string]interface{}{"rank": result.Rank, "id": result.ID}, nil
+		})
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	return results, info, nil
+}
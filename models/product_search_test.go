@@ -0,0 +1,30 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchCursorKeepsExactRank(t *testing.T) {
+	ks, err := newKeyset(searchQueryFields, []SortKey{{Field: "rank", Desc: true}}, "id")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ts_rank computes a real; widened to float8 it has digits that its
+	// shortest 32-bit form doesn't carry.
+	rank := float64(float32(0.0607927))
+	cursor := ks.encodeCursor(map[string]interface{}{"rank": rank, "id": 42})
+
+	var args []interface{}
+	condition, err := ks.after(cursor, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 2 || args[0] != rank || args[1] != int32(42) {
+		t.Errorf("cursor values = %#v, want [%v 42]", args, rank)
+	}
+	if !strings.Contains(condition, "ts_rank(p.search_vector, q.query)::float8 < $1") {
+		t.Errorf("condition = %s, want the rank compared as float8", condition)
+	}
+}
@@ -10,4 +10,10 @@ type Product struct {
 	StockQuantity int       `json:"stock_quantity"`
 	CreatedAt     time.Time `json:"created_at"`
 	OwnerID       int
+	// Breadcrumbs holds one path from the root category down for each
+	// category the product is in. Only filled in for API responses.
+	Breadcrumbs [][]CategoryRef `json:"breadcrumbs,omitempty"`
+	// Options and Variants are likewise only filled in for API responses.
+	Options  []ProductOption   `json:"options,omitempty"`
+	Variants []*ProductVariant `json:"variants,omitempty"`
 }
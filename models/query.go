@@ -0,0 +1,312 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// List endpoints accept a small filter and sort language:
+//
+//	filter := condition ("," condition)*
+//	condition := field operator value
+//	operator := "=" | "!=" | ">" | ">=" | "<" | "<=" | "~"
+//	value := bare text up to the next "," | "\"" quoted text "\""
+//	sort := key ("," key)*
+//	key := ["-" | "+"] field
+//
+// e.g. filter `price>=10,stock_quantity>0,name~shirt` and sort `-price,name`.
+// Conditions are ANDed; "~" is a case-insensitive substring match. Inside
+// quotes, \" and \\ escape a quote and a backslash. Expressions are parsed
+// into conditions and sort keys and only become SQL through a QuerySchema,
+// which maps the allowed fields to columns and every value to a parameter;
+// see pagination.go for the ORDER BY side.
+
+const (
+	maxFilterConditions = 20
+	maxSortKeys         = 5
+)
+
+type FieldType int
+
+const (
+	FieldText FieldType = iota
+	FieldInteger
+	FieldBigInteger
+	FieldNumber
+	FieldTime
+)
+
+// QueryField describes a field that clients may filter and sort on.
+type QueryField struct {
+	Column   string
+	Type     FieldType
+	Sortable bool
+	// Condition replaces "Column <operator> value" for fields that aren't
+	// plain columns. It is SQL with a %s for the value's parameter and only
+	// supports "=".
+	Condition string
+}
+
+// QuerySchema is the allowlist of fields for one listing, by public name.
+type QuerySchema map[string]QueryField
+
+type FilterCondition struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// QueryError reports a bad filter or sort expression. Clause is "filter" or
+// "sort"; Rule names what is wrong, like FieldError.Rule.
+type QueryError struct {
+	Clause  string
+	Rule    string
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return e.Clause + ": " + e.Message
+}
+
+// Longer operators come first so ">=" isn't read as ">".
+var filterOperators = []string{">=", "<=", "!=", "=", ">", "<", "~"}
+
+var fieldOperators = map[FieldType]map[string]bool{
+	FieldText:       {"=": true, "!=": true, "~": true},
+	FieldInteger:    {"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true},
+	FieldBigInteger: {"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true},
+	FieldNumber:     {"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true},
+	FieldTime:       {"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true},
+}
+
+func isFieldNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+// ParseFilter parses a filter expression. An empty expression has no
+// conditions.
+func ParseFilter(expr string) ([]FilterCondition, error) {
+	var conditions []FilterCondition
+	syntaxError := func(pos int, message string) error {
+		return &QueryError{Clause: "filter", Rule: "syntax", Message: fmt.Sprintf("%s at position %d", message, pos+1)}
+	}
+
+	pos := 0
+	skipSpaces := func() {
+		for pos < len(expr) && expr[pos] == ' ' {
+			pos++
+		}
+	}
+
+	skipSpaces()
+	if pos == len(expr) {
+		return nil, nil
+	}
+
+	for {
+		skipSpaces()
+		start := pos
+		for pos < len(expr) && isFieldNameChar(expr[pos], pos == start) {
+			pos++
+		}
+		if pos == start {
+			return nil, syntaxError(pos, "expected a field name")
+		}
+		field := expr[start:pos]
+
+		skipSpaces()
+		operator := ""
+		for _, op := range filterOperators {
+			if strings.HasPrefix(expr[pos:], op) {
+				operator = op
+				break
+			}
+		}
+		if operator == "" {
+			return nil, syntaxError(pos, "expected one of "+strings.Join(filterOperators, " "))
+		}
+		pos += len(operator)
+
+		skipSpaces()
+		var value string
+		if pos < len(expr) && expr[pos] == '"' {
+			var b strings.Builder
+			pos++
+			closed := false
+			for pos < len(expr) {
+				c := expr[pos]
+				if c == '\\' && pos+1 < len(expr) && (expr[pos+1] == '"' || expr[pos+1] == '\\') {
+					b.WriteByte(expr[pos+1])
+					pos += 2
+					continue
+				}
+				pos++
+				if c == '"' {
+					closed = true
+					break
+				}
+				b.WriteByte(c)
+			}
+			if !closed {
+				return nil, syntaxError(pos, "unterminated quoted value")
+			}
+			value = b.String()
+			skipSpaces()
+		} else {
+			start := pos
+			for pos < len(expr) && expr[pos] != ',' {
+				if expr[pos] == '"' {
+					return nil, syntaxError(pos, "unexpected quote, quote the whole value")
+				}
+				pos++
+			}
+			value = strings.TrimRight(expr[start:pos], " ")
+			if value == "" {
+				return nil, syntaxError(pos, "expected a value")
+			}
+		}
+
+		conditions = append(conditions, FilterCondition{Field: field, Operator: operator, Value: value})
+		if len(conditions) > maxFilterConditions {
+			return nil, &QueryError{Clause: "filter", Rule: "max", Message: fmt.Sprintf("at most %d conditions are allowed", maxFilterConditions)}
+		}
+
+		if pos == len(expr) {
+			return conditions, nil
+		}
+		if expr[pos] != ',' {
+			return nil, syntaxError(pos, `expected "," between conditions`)
+		}
+		pos++
+	}
+}
+
+// ParseSort parses a sort expression. Keys prefixed with "-" sort
+// descending. An empty expression has no keys.
+func ParseSort(expr string) ([]SortKey, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+
+	var keys []SortKey
+	seen := make(map[string]bool)
+	for i, part := range strings.Split(expr, ",") {
+		part = strings.TrimSpace(part)
+		key := SortKey{}
+		if strings.HasPrefix(part, "-") {
+			key.Desc = true
+			part = part[1:]
+		} else {
+			part = strings.TrimPrefix(part, "+")
+		}
+
+		valid := part != ""
+		for j := 0; j < len(part); j++ {
+			if !isFieldNameChar(part[j], j == 0) {
+				valid = false
+			}
+		}
+		if !valid {
+			return nil, &QueryError{Clause: "sort", Rule: "syntax", Message: fmt.Sprintf("key %d must be a field name, optionally prefixed with - or +", i+1)}
+		}
+		if seen[part] {
+			return nil, &QueryError{Clause: "sort", Rule: "syntax", Message: fmt.Sprintf("field %q is listed twice", part)}
+		}
+		seen[part] = true
+
+		key.Field = part
+		keys = append(keys, key)
+	}
+	if len(keys) > maxSortKeys {
+		return nil, &QueryError{Clause: "sort", Rule: "max", Message: fmt.Sprintf("at most %d keys are allowed", maxSortKeys)}
+	}
+	return keys, nil
+}
+
+// CompileFilter checks the conditions against the schema and turns them into
+// a SQL condition, appending the values to args as parameters. It returns ""
+// when there are no conditions.
+func (s QuerySchema) CompileFilter(conditions []FilterCondition, args *[]interface{}) (string, error) {
+	var clauses []string
+	for _, condition := range conditions {
+		field, ok := s[condition.Field]
+		if !ok {
+			return "", &QueryError{Clause: "filter", Rule: "field", Message: fmt.Sprintf("unknown field %q, allowed: %s", condition.Field, s.fieldNames(false))}
+		}
+		if !fieldOperators[field.Type][condition.Operator] || (field.Condition != "" && condition.Operator != "=") {
+			return "", &QueryError{Clause: "filter", Rule: "operator", Message: fmt.Sprintf("operator %q is not supported on %s", condition.Operator, condition.Field)}
+		}
+
+		value, err := parseFilterValue(field.Type, condition.Value)
+		if err != nil {
+			return "", &QueryError{Clause: "filter", Rule: "value", Message: fmt.Sprintf("%s: %v", condition.Field, err)}
+		}
+
+		operator := condition.Operator
+		if operator == "~" {
+			operator = "ILIKE"
+			value = "%" + escapeLike(condition.Value) + "%"
+		}
+		*args = append(*args, value)
+		placeholder := fmt.Sprintf("$%d", len(*args))
+		if field.Condition != "" {
+			clauses = append(clauses, fmt.Sprintf(field.Condition, placeholder))
+		} else {
+			clauses = append(clauses, field.Column+" "+operator+" "+placeholder)
+		}
+	}
+
+	return strings.Join(clauses, " AND "), nil
+}
+
+func (s QuerySchema) fieldNames(sortable bool) string {
+	var names []string
+	for name, field := range s {
+		if !sortable || field.Sortable {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func parseFilterValue(fieldType FieldType, value string) (interface{}, error) {
+	switch fieldType {
+	case FieldInteger:
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a 32-bit integer", value)
+		}
+		return int32(n), nil
+	case FieldBigInteger:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", value)
+		}
+		return n, nil
+	case FieldNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return n, nil
+	case FieldTime:
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			return t, nil
+		}
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			return t, nil
+		}
+		return nil, fmt.Errorf("%q is not an RFC 3339 timestamp or a YYYY-MM-DD date", value)
+	}
+	return value, nil
+}
@@ -0,0 +1,49 @@
+package models
+
+import "context"
+
+const (
+	RoleCustomer = "customer"
+	RoleSeller   = "seller"
+	RoleAdmin    = "admin"
+)
+
+func GetRolePermissions(role string) ([]string, error) {
+	var permissions []string
+
+	query := `
+        SELECT permission FROM role_permissions
+        WHERE role = $1
+        ORDER BY permission
+    `
+	rows, err := db.Query(context.Background(), query, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+func RoleExists(role string) (bool, error) {
+	var exists bool
+
+	query := `SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)`
+	err := db.QueryRow(context.Background(), query, role).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
@@ -0,0 +1,213 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// TokenFamily is one login session: every refresh token rotated from the
+// same login belongs to it, and revoking it logs that device out.
+type TokenFamily struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type RefreshToken struct {
+	ID        int
+	FamilyID  string
+	UserID    int
+	TokenHash string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+	// FamilyRevokedAt is filled in from token_families when the token is loaded.
+	FamilyRevokedAt *time.Time
+}
+
+func CreateTokenFamily(family *TokenFamily) error {
+	query := `
+        INSERT INTO token_families (id, user_id, user_agent, ip)
+        VALUES ($1, $2, $3, $4)
+        RETURNING created_at, last_seen_at
+    `
+	row := db.QueryRow(context.Background(), query, family.ID, family.UserID, family.UserAgent, family.IP)
+	err := row.Scan(&family.CreatedAt, &family.LastSeenAt)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TouchTokenFamily reports whether the family is still active and its user
+// not suspended, and bumps its last_seen_at, at most once a minute.
+func TouchTokenFamily(familyID string) (bool, error) {
+	var active bool
+
+	query := `
+        WITH touched AS (
+            UPDATE token_families
+            SET last_seen_at = now()
+            WHERE id = $1 AND revoked_at IS NULL AND last_seen_at < now() - interval '1 minute'
+        )
+        SELECT EXISTS (
+            SELECT 1 FROM token_families f
+            JOIN users u ON u.id = f.user_id
+            WHERE f.id = $1 AND f.revoked_at IS NULL AND u.suspended_at IS NULL
+        )
+    `
+	err := db.QueryRow(context.Background(), query, familyID).Scan(&active)
+	if err != nil {
+		return false, err
+	}
+
+	return active, nil
+}
+
+func GetActiveTokenFamiliesByUserID(userID int) ([]*TokenFamily, error) {
+	var families []*TokenFamily
+
+	query := `
+        SELECT id, user_id, user_agent, ip, created_at, last_seen_at, revoked_at
+        FROM token_families
+        WHERE user_id = $1 AND revoked_at IS NULL
+        ORDER BY last_seen_at DESC
+    `
+	rows, err := db.Query(context.Background(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var family TokenFamily
+		err := rows.Scan(&family.ID, &family.UserID, &family.UserAgent, &family.IP, &family.CreatedAt, &family.LastSeenAt, &family.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+		families = append(families, &family)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return families, nil
+}
+
+// RevokeUserTokenFamily revokes one of the user's sessions. It returns false
+// if the session doesn't exist, belongs to someone else or is already revoked.
+func RevokeUserTokenFamily(userID int, familyID string) (bool, error) {
+	query := `
+        UPDATE token_families
+        SET revoked_at = now()
+        WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+    `
+	tag, err := db.Exec(context.Background(), query, familyID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func RevokeOtherTokenFamilies(userID int, keepFamilyID string) error {
+	query := `
+        UPDATE token_families
+        SET revoked_at = now()
+        WHERE user_id = $1 AND id <> $2 AND revoked_at IS NULL
+    `
+	_, err := db.Exec(context.Background(), query, userID, keepFamilyID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token families: %v", err)
+	}
+
+	return nil
+}
+
+func RevokeTokenFamily(familyID string) error {
+	query := `
+        UPDATE token_families
+        SET revoked_at = now()
+        WHERE id = $1 AND revoked_at IS NULL
+    `
+	_, err := db.Exec(context.Background(), query, familyID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token family: %v", err)
+	}
+
+	return nil
+}
+
+func RevokeUserTokenFamilies(userID int) error {
+	query := `
+        UPDATE token_families
+        SET revoked_at = now()
+        WHERE user_id = $1 AND revoked_at IS NULL
+    `
+	_, err := db.Exec(context.Background(), query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token families: %v", err)
+	}
+
+	return nil
+}
+
+func CreateRefreshToken(token *RefreshToken) error {
+	query := `
+        INSERT INTO refresh_tokens (family_id, token_hash, expires_at)
+        VALUES ($1, $2, $3)
+        RETURNING id, created_at
+    `
+	row := db.QueryRow(context.Background(), query, token.FamilyID, token.TokenHash, token.ExpiresAt)
+	err := row.Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func GetRefreshTokenByHash(tokenHash string) (*RefreshToken, error) {
+	var token RefreshToken
+
+	query := `
+        SELECT rt.id, rt.family_id, tf.user_id, rt.token_hash, rt.expires_at, rt.used_at, rt.created_at, tf.revoked_at
+        FROM refresh_tokens rt
+        JOIN token_families tf ON tf.id = rt.family_id
+        WHERE rt.token_hash = $1
+        LIMIT 1
+    `
+	row := db.QueryRow(context.Background(), query, tokenHash)
+	err := row.Scan(&token.ID, &token.FamilyID, &token.UserID, &token.TokenHash, &token.ExpiresAt, &token.UsedAt, &token.CreatedAt, &token.FamilyRevokedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// MarkRefreshTokenUsed atomically consumes a refresh token. It returns false
+// if the token had already been used, which means it is being replayed.
+func MarkRefreshTokenUsed(tokenID int) (bool, error) {
+	query := `
+        UPDATE refresh_tokens
+        SET used_at = now()
+        WHERE id = $1 AND used_at IS NULL
+    `
+	tag, err := db.Exec(context.Background(), query, tokenID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
@@ -0,0 +1,103 @@
+package models
+
+import "context"
+
+// SetPendingTOTPSecret stores a secret that still has to be confirmed with a
+// valid code before two-factor authentication is turned on.
+func SetPendingTOTPSecret(userID int, secret string) error {
+	query := `
+        UPDATE users
+        SET totp_secret = $1, totp_enabled_at = NULL, totp_last_step = 0
+        WHERE id = $2 AND totp_enabled_at IS NULL
+    `
+	_, err := db.Exec(context.Background(), query, secret, userID)
+	return err
+}
+
+// EnableTOTP turns on two-factor authentication and replaces the user's
+// recovery codes in one transaction.
+func EnableTOTP(userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), `
+        UPDATE users
+        SET totp_enabled_at = now(), totp_last_step = $1
+        WHERE id = $2
+    `, step, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.Exec(context.Background(), "INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, codeHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func DisableTOTP(userID int) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), `
+        UPDATE users
+        SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = 0
+        WHERE id = $1
+    `, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM recovery_codes WHERE user_id = $1", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// AdvanceTOTPStep records step as the last accepted one. It returns false if
+// an equal or later step was already used.
+func AdvanceTOTPStep(userID int, step int64) (bool, error) {
+	query := `
+        UPDATE users
+        SET totp_last_step = $1
+        WHERE id = $2 AND totp_last_step < $1
+    `
+	tag, err := db.Exec(context.Background(), query, step, userID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// UseRecoveryCode consumes a matching unused recovery code.
+func UseRecoveryCode(userID int, codeHash string) (bool, error) {
+	query := `
+        UPDATE recovery_codes
+        SET used_at = now()
+        WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+    `
+	tag, err := db.Exec(context.Background(), query, userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
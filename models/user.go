@@ -1,8 +1,21 @@
 package models
 
+import "time"
+
 type User struct {
-	ID       int    `json:"id"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Email    string `json:"email"`
+	ID              int        `json:"id"`
+	Username        string     `json:"username"`
+	Password        string     `json:"-"`
+	Email           string     `json:"email"`
+	Role            string     `json:"role"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	TOTPSecret      string     `json:"-"`
+	TOTPEnabledAt   *time.Time `json:"totp_enabled_at"`
+	TOTPLastStep    int64      `json:"-"`
+	// ErasureScheduledAt is set while a requested account erasure is in its
+	// grace period; AnonymizedAt once the personal data has been removed.
+	ErasureScheduledAt *time.Time `json:"erasure_scheduled_at"`
+	AnonymizedAt       *time.Time `json:"anonymized_at"`
+	SuspendedAt        *time.Time `json:"suspended_at"`
+	SuspendedReason    string     `json:"suspended_reason"`
 }
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"strings"
+)
+
+// UserSearch filters the admin user listing. Empty fields don't filter.
+type UserSearch struct {
+	// Query matches username or email, case-insensitively, anywhere.
+	Query string
+	Role  string
+	// Status is one of active, suspended, pending_erasure or anonymized.
+	Status string
+}
+
+var userQueryFields = QuerySchema{
+	"id": {Column: "id", Type: FieldInteger, Sortable: true},
+}
+
+// SearchUsers returns one page of users ordered by ID.
+func SearchUsers(search UserSearch, page PageRequest) ([]*User, PageInfo, error) {
+	var conditions []string
+	var args []interface{}
+
+	if search.Query != "" {
+		args = append(args, "%"+escapeLike(search.Query)+"%")
+		conditions = append(conditions, fmt.Sprintf("(username ILIKE $%d OR email ILIKE $%d)", len(args), len(args)))
+	}
+	if search.Role != "" {
+		args = append(args, search.Role)
+		conditions = append(conditions, fmt.Sprintf("role = $%d", len(args)))
+	}
+	switch search.Status {
+	case "active":
+		conditions = append(conditions, "suspended_at IS NULL AND anonymized_at IS NULL")
+	case "suspended":
+		conditions = append(conditions, "suspended_at IS NOT NULL")
+	case "pending_erasure":
+		conditions = append(conditions, "erasure_scheduled_at IS NOT NULL")
+	case "anonymized":
+		conditions = append(conditions, "anonymized_at IS NOT NULL")
+	}
+
+	ks, err := newKeyset(userQueryFields, nil, "id")
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	var users []*User
+	info, err := queryPage(ks, userColumns, "users", conditions, args, page,
+		func(rows pgx.Rows) (map[string]interface{}, error) {
+			var user User
+			if err := scanUser(rows, &user); err != nil {
+				return nil, err
+			}
+			users = append(users, &user)
+			return map[string]interface{}{"id": user.ID}, nil
+		})
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	return users, info, nil
+}
+
+// escapeLike escapes the LIKE wildcards in user input.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// SuspendUser blocks the account and revokes all of its sessions in one
+// transaction. API keys stop working while the account is suspended.
+func SuspendUser(userID int, reason string) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), `
+        UPDATE users
+        SET suspended_at = COALESCE(suspended_at, now()), suspended_reason = $1
+        WHERE id = $2
+    `, reason, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), "UPDATE token_families SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// ForcePasswordReset replaces the password and revokes every session and
+// API key of the user in one transaction.
+func ForcePasswordReset(userID int, passwordHash string) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE users SET password = $1 WHERE id = $2", passwordHash, userID)
+	if err != nil {
+		return err
+	}
+	if err := revokeUserCredentials(tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit(context.Background())
+}
+
+func UnsuspendUser(userID int) error {
+	query := `
+        UPDATE users
+        SET suspended_at = NULL, suspended_reason = ''
+        WHERE id = $1
+    `
+	_, err := db.Exec(context.Background(), query, userID)
+	return err
+}
+
+func UpdateUserRole(userID int, role string) error {
+	query := `
+        UPDATE users
+        SET role = $1
+        WHERE id = $2
+    `
+	_, err := db.Exec(context.Background(), query, role, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update role: %v", err)
+	}
+
+	return nil
+}
@@ -2,20 +2,38 @@ package models
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v4"
+	"sort"
 )
 
+// IsUniqueViolation reports whether err comes from a unique constraint.
+func IsUniqueViolation(err error) bool {
+	var pgErr interface{ SQLState() string }
+	return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+}
+
+// userColumns is the column list scanUser expects, shared by every query
+// that loads a full User.
+const userColumns = "id, username, password, email, role, email_verified_at, COALESCE(totp_secret, ''), totp_enabled_at, totp_last_step, erasure_scheduled_at, anonymized_at, suspended_at, suspended_reason"
+
+func scanUser(row pgx.Row, user *User) error {
+	return row.Scan(&user.ID, &user.Username, &user.Password, &user.Email, &user.Role, &user.EmailVerifiedAt,
+		&user.TOTPSecret, &user.TOTPEnabledAt, &user.TOTPLastStep, &user.ErasureScheduledAt, &user.AnonymizedAt,
+		&user.SuspendedAt, &user.SuspendedReason)
+}
+
 func GetUserByUsernameOrEmail(username, email string) (*User, error) {
 	var user User
 
 	query := `
-        SELECT id, username, password, email FROM users
+        SELECT ` + userColumns + ` FROM users
         WHERE username = $1 OR email = $2
         LIMIT 1
     `
 	row := db.QueryRow(context.Background(), query, username, email)
-	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Email)
+	err := scanUser(row, &user)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil // Не найдено пользователя с таким именем или email
@@ -27,11 +45,14 @@ func GetUserByUsernameOrEmail(username, email string) (*User, error) {
 }
 func CreateUser(user *User) error {
 	query := `
-        INSERT INTO users (username, password, email)
-        VALUES ($1, $2, $3)
+        INSERT INTO users (username, password, email, role)
+        VALUES ($1, $2, $3, $4)
         RETURNING id
     `
-	row := db.QueryRow(context.Background(), query, user.Username, user.Password, user.Email)
+	if user.Role == "" {
+		user.Role = RoleCustomer
+	}
+	row := db.QueryRow(context.Background(), query, user.Username, user.Password, user.Email, user.Role)
 	err := row.Scan(&user.ID)
 	if err != nil {
 		return err
@@ -44,37 +65,84 @@ func GetUserByUsername(username string) (*User, error) {
 	var user User
 
 	query := `
-        SELECT id, username, password, email FROM users
+        SELECT ` + userColumns + ` FROM users
         WHERE username = $1
         LIMIT 1
     `
 	row := db.QueryRow(context.Background(), query, username)
-	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Email)
+	err := scanUser(row, &user)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+func GetUserByEmail(email string) (*User, error) {
+	var user User
+
+	query := `
+        SELECT ` + userColumns + ` FROM users
+        WHERE email = $1
+        LIMIT 1
+    `
+	row := db.QueryRow(context.Background(), query, email)
+	err := scanUser(row, &user)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func GetUserByID(userID int) (*User, error) {
+	var user User
+
+	query := `
+        SELECT ` + userColumns + ` FROM users
+        WHERE id = $1
+        LIMIT 1
+    `
+	row := db.QueryRow(context.Background(), query, userID)
+	err := scanUser(row, &user)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
 		return nil, err
 	}
 
 	return &user, nil
 }
+
+// UpdateUserProfile saves username and email. A changed email loses its
+// verified status; the password is changed through UpdateUserPassword only.
 func UpdateUserProfile(updatedProfile *User) error {
 	query := `
         UPDATE users
-        SET username = $1, password = $2, email = $3
-        WHERE id = $4
+        SET username = $1, email = $2,
+            email_verified_at = CASE WHEN email = $2 THEN email_verified_at END
+        WHERE id = $3
     `
-	_, err := db.Exec(context.Background(), query, updatedProfile.Username, updatedProfile.Password, updatedProfile.Email, updatedProfile.ID)
+	_, err := db.Exec(context.Background(), query, updatedProfile.Username, updatedProfile.Email, updatedProfile.ID)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
-func DeleteUserProfile(userID int) error {
+func UpdateUserPassword(userID int, passwordHash string) error {
 	query := `
-        DELETE FROM users
-        WHERE id = $1
+        UPDATE users
+        SET password = $1
+        WHERE id = $2
     `
-	_, err := db.Exec(context.Background(), query, userID)
+	_, err := db.Exec(context.Background(), query, passwordHash, userID)
 	if err != nil {
 		return err
 	}
@@ -96,44 +164,60 @@ func CreateProduct(product *Product) error {
 	return nil
 }
 
-func GetProducts(pageNumber, pageSize int, sortBy, filterBy string) ([]*Product, error) {
-	query := `
-        SELECT id, name, description, price, stock_quantity, created_at, owner_id
-        FROM products
-    `
-
-	if filterBy != "" {
-		query += fmt.Sprintf(" WHERE %s", filterBy)
-	}
+// ProductQueryFields are the product fields clients may filter and sort on.
+var ProductQueryFields = QuerySchema{
+	"id":             {Column: "id", Type: FieldInteger, Sortable: true},
+	"name":           {Column: "name", Type: FieldText, Sortable: true},
+	"description":    {Column: "description", Type: FieldText},
+	"price":          {Column: "price", Type: FieldNumber, Sortable: true},
+	"stock_quantity": {Column: "stock_quantity", Type: FieldInteger, Sortable: true},
+	"created_at":     {Column: "created_at", Type: FieldTime, Sortable: true},
+	"owner_id":       {Column: "owner_id", Type: FieldInteger, Sortable: true},
+	// category matches products in the category or any of its descendants.
+	"category": {Type: FieldInteger, Condition: "id IN (SELECT product_id FROM product_categories WHERE category_id IN (SELECT category_subtree(%s)))"},
+}
 
-	if sortBy != "" {
-		query += fmt.Sprintf(" ORDER BY %s", sortBy)
+// GetProducts returns a page of products. Fields in filter and page.Sort
+// that ProductQueryFields doesn't allow are rejected with a *QueryError.
+func GetProducts(filter []FilterCondition, page PageRequest) ([]*Product, PageInfo, error) {
+	ks, err := newKeyset(ProductQueryFields, page.Sort, "id")
+	if err != nil {
+		return nil, PageInfo{}, err
 	}
-
-	offset := (pageNumber - 1) * pageSize
-	query += fmt.Sprintf(" LIMIT %d OFFSET %d", pageSize, offset)
-
-	// Выполняем запрос к базе данных
-	rows, err := db.Query(context.Background(), query)
+	var args []interface{}
+	where, err := ProductQueryFields.CompileFilter(filter, &args)
 	if err != nil {
-		return nil, err
+		return nil, PageInfo{}, err
+	}
+	var conditions []string
+	if where != "" {
+		conditions = append(conditions, where)
 	}
-	defer rows.Close()
 
 	var products []*Product
-	for rows.Next() {
-		var product Product
-		err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.StockQuantity, &product.CreatedAt, &product.OwnerID)
-		if err != nil {
-			return nil, err
-		}
-		products = append(products, &product)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	info, err := queryPage(ks, "id, name, description, price, stock_quantity, created_at, owner_id", "products", conditions, args, page,
+		func(rows pgx.Rows) (map[string]interface{}, error) {
+			var product Product
+			err := rows.Scan(&product.ID, &product.Name, &product.Description, &product.Price, &product.StockQuantity, &product.CreatedAt, &product.OwnerID)
+			if err != nil {
+				return nil, err
+			}
+			products = append(products, &product)
+			return map[string]interface{}{
+				"id":             product.ID,
+				"name":           product.Name,
+				"description":    product.Description,
+				"price":          product.Price,
+				"stock_quantity": product.StockQuantity,
+				"created_at":     product.CreatedAt,
+				"owner_id":       product.OwnerID,
+			}, nil
+		})
+	if err != nil {
+		return nil, PageInfo{}, err
 	}
 
-	return products, nil
+	return products, info, nil
 }
 
 func GetAllProducts() ([]*Product, error) {
@@ -240,13 +324,16 @@ func GetProductsByOwnerID(ownerID int) ([]*Product, error) {
 
 	return products, nil
 }
+
+// GetCartByUserID returns the user's cart in the order the items were added.
 func GetCartByUserID(userID int) ([]CartItem, error) {
 	var cartItems []CartItem
 
 	query := `
-		SELECT id, user_id, product_id, quantity, created_at
+		SELECT id, user_id, product_id, variant_id, quantity, created_at
 		FROM cart_items
 		WHERE user_id = $1
+		ORDER BY id
 	`
 	rows, err := db.Query(context.Background(), query, userID)
 	if err != nil {
@@ -256,7 +343,7 @@ func GetCartByUserID(userID int) ([]CartItem, error) {
 
 	for rows.Next() {
 		var cartItem CartItem
-		err := rows.Scan(&cartItem.ID, &cartItem.UserID, &cartItem.ProductID, &cartItem.Quantity, &cartItem.CreatedAt)
+		err := rows.Scan(&cartItem.ID, &cartItem.UserID, &cartItem.ProductID, &cartItem.VariantID, &cartItem.Quantity, &cartItem.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -270,38 +357,47 @@ func GetCartByUserID(userID int) ([]CartItem, error) {
 	return cartItems, nil
 }
 
-func AddProductToCart(cartItem *CartItem) error {
-	query := `
-		INSERT INTO cart_items (user_id, product_id, quantity)
-		VALUES ($1, $2, $3)
-	`
-	_, err := db.Exec(context.Background(), query, cartItem.UserID, cartItem.ProductID, cartItem.Quantity)
+var cartItemQueryFields = QuerySchema{
+	"id": {Column: "id", Type: FieldInteger, Sortable: true},
+}
+
+// GetCartPage returns a page of the user's cart, in the order the items
+// were added.
+func GetCartPage(userID int, page PageRequest) ([]CartItem, PageInfo, error) {
+	ks, err := newKeyset(cartItemQueryFields, nil, "id")
 	if err != nil {
-		return err
+		return nil, PageInfo{}, err
 	}
 
-	return nil
-}
+	var cartItems []CartItem
+	info, err := queryPage(ks, "id, user_id, product_id, variant_id, quantity, created_at", "cart_items", []string{"user_id = $1"}, []interface{}{userID}, page,
+		func(rows pgx.Rows) (map[string]interface{}, error) {
+			var cartItem CartItem
+			err := rows.Scan(&cartItem.ID, &cartItem.UserID, &cartItem.ProductID, &cartItem.VariantID, &cartItem.Quantity, &cartItem.CreatedAt)
+			if err != nil {
+				return nil, err
+			}
+			cartItems = append(cartItems, cartItem)
+			return map[string]interface{}{"id": cartItem.ID}, nil
+		})
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
 
-func GetCartItemByProductID(cartID, productID int) (*CartItem, error) {
-	var cartItem CartItem
+	return cartItems, info, nil
+}
 
+func AddProductToCart(cartItem *CartItem) error {
 	query := `
-        SELECT id, user_id, product_id, quantity, created_at
-        FROM cart_items
-        WHERE cart_id = $1 AND product_id = $2
-        LIMIT 1
-    `
-	row := db.QueryRow(context.Background(), query, cartID, productID)
-	err := row.Scan(&cartItem.ID, &cartItem.UserID, &cartItem.ProductID, &cartItem.Quantity, &cartItem.CreatedAt)
+		INSERT INTO cart_items (user_id, product_id, variant_id, quantity)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := db.Exec(context.Background(), query, cartItem.UserID, cartItem.ProductID, cartItem.VariantID, cartItem.Quantity)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			return nil, nil // Продукт с указанным ID не найден в корзине
-		}
-		return nil, err
+		return err
 	}
 
-	return &cartItem, nil
+	return nil
 }
 
 func UpdateCartItem(cartItem *CartItem) error {
@@ -318,39 +414,22 @@ func UpdateCartItem(cartItem *CartItem) error {
 	return nil
 }
 
-func UpdateCartByUserID(userID int, cart []CartItem) error {
-	tx, err := db.Begin(context.Background())
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback(context.Background())
-
-	_, err = tx.Exec(context.Background(), "DELETE FROM cart_items WHERE user_id = $1", userID)
+// RemoveCartItem deletes one line of the user's cart. The other lines keep
+// their IDs, so the cart order and open cursors are unaffected.
+func RemoveCartItem(userID, cartItemID int) (bool, error) {
+	tag, err := db.Exec(context.Background(), "DELETE FROM cart_items WHERE id = $1 AND user_id = $2", cartItemID, userID)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	for _, item := range cart {
-		_, err := tx.Exec(context.Background(), "INSERT INTO cart_items (user_id, product_id, quantity) VALUES ($1, $2, $3)",
-			userID, item.ProductID, item.Quantity)
-		if err != nil {
-			return err
-		}
-	}
-
-	err = tx.Commit(context.Background())
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return tag.RowsAffected() == 1, nil
 }
 
 func GetOrdersByUserID(userID int) ([]*Order, error) {
 	var orders []*Order
 
 	query := `
-        SELECT id, user_id, total_amount, status, created_at
+        SELECT id, user_id, total_amount, status, created_at, shipping_address, billing_address
         FROM orders
         WHERE user_id = $1
     `
@@ -362,7 +441,7 @@ func GetOrdersByUserID(userID int) ([]*Order, error) {
 
 	for rows.Next() {
 		var order Order
-		err := rows.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt)
+		err := rows.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.ShippingAddress, &order.BillingAddress)
 		if err != nil {
 			return nil, err
 		}
@@ -376,17 +455,67 @@ func GetOrdersByUserID(userID int) ([]*Order, error) {
 	return orders, nil
 }
 
+// OrderQueryFields are the order fields clients may filter and sort on.
+var OrderQueryFields = QuerySchema{
+	"id":           {Column: "id", Type: FieldInteger, Sortable: true},
+	"user_id":      {Column: "user_id", Type: FieldInteger, Sortable: true},
+	"total_amount": {Column: "total_amount", Type: FieldNumber, Sortable: true},
+	"status":       {Column: "status", Type: FieldText, Sortable: true},
+	"created_at":   {Column: "created_at", Type: FieldTime, Sortable: true},
+}
+
+// GetOrders returns a page of orders, rejecting fields OrderQueryFields
+// doesn't allow with a *QueryError.
+func GetOrders(filter []FilterCondition, page PageRequest) ([]*Order, PageInfo, error) {
+	ks, err := newKeyset(OrderQueryFields, page.Sort, "id")
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	var args []interface{}
+	where, err := OrderQueryFields.CompileFilter(filter, &args)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+	var conditions []string
+	if where != "" {
+		conditions = append(conditions, where)
+	}
+
+	var orders []*Order
+	info, err := queryPage(ks, "id, user_id, total_amount, status, created_at, shipping_address, billing_address", "orders", conditions, args, page,
+		func(rows pgx.Rows) (map[string]interface{}, error) {
+			var order Order
+			err := rows.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.ShippingAddress, &order.BillingAddress)
+			if err != nil {
+				return nil, err
+			}
+			orders = append(orders, &order)
+			return map[string]interface{}{
+				"id":           order.ID,
+				"user_id":      order.UserID,
+				"total_amount": order.TotalAmount,
+				"status":       order.Status,
+				"created_at":   order.CreatedAt,
+			}, nil
+		})
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	return orders, info, nil
+}
+
 func GetOrderByID(orderID int) (*Order, error) {
 	var order Order
 
 	query := `
-        SELECT id, user_id, total_amount, status, created_at
+        SELECT id, user_id, total_amount, status, created_at, shipping_address, billing_address
         FROM orders
         WHERE id = $1
         LIMIT 1
     `
 	row := db.QueryRow(context.Background(), query, orderID)
-	err := row.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt)
+	err := row.Scan(&order.ID, &order.UserID, &order.TotalAmount, &order.Status, &order.CreatedAt, &order.ShippingAddress, &order.BillingAddress)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return nil, nil // Заказ с указанным ID не найден
@@ -397,58 +526,234 @@ func GetOrderByID(orderID int) (*Order, error) {
 	return &order, nil
 }
 
-func CreateOrder(order *Order) error {
+// OutOfStockError is returned by PlaceOrder when a variant doesn't have the
+// ordered quantity left.
+type OutOfStockError struct {
+	VariantID int
+}
+
+func (e *OutOfStockError) Error() string {
+	return fmt.Sprintf("variant %d is out of stock", e.VariantID)
+}
+
+// PlaceOrder creates the order and its items and takes the ordered
+// quantities of variants out of stock, all in one transaction. Nothing is
+// written if any variant runs short.
+// sortedVariantIDs lists the variants in ID order. Stock is always updated
+// in that order, so concurrent transactions lock the rows in the same order.
+func sortedVariantIDs(quantities map[int]int) []int {
+	variantIDs := make([]int, 0, len(quantities))
+	for variantID := range quantities {
+		variantIDs = append(variantIDs, variantID)
+	}
+	sort.Ints(variantIDs)
+	return variantIDs
+}
+
+// takeVariantStock takes the quantities, by variant ID, out of stock. It
+// returns an OutOfStockError if a variant runs short.
+func takeVariantStock(tx pgx.Tx, quantities map[int]int) error {
+	for _, variantID := range sortedVariantIDs(quantities) {
+		tag, err := tx.Exec(context.Background(), `
+            UPDATE product_variants
+            SET stock_quantity = stock_quantity - $2
+            WHERE id = $1 AND stock_quantity >= $2
+        `, variantID, quantities[variantID])
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return &OutOfStockError{VariantID: variantID}
+		}
+	}
+	return nil
+}
+
+// returnVariantStock puts the quantities, by variant ID, back in stock.
+func returnVariantStock(tx pgx.Tx, quantities map[int]int) error {
+	for _, variantID := range sortedVariantIDs(quantities) {
+		_, err := tx.Exec(context.Background(), `
+            UPDATE product_variants
+            SET stock_quantity = stock_quantity + $2
+            WHERE id = $1
+        `, variantID, quantities[variantID])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderedVariantQuantities sums the quantity of each variant ordered in the
+// order. Items whose variant has since been deleted are left out.
+func orderedVariantQuantities(tx pgx.Tx, orderID int) (map[int]int, error) {
+	rows, err := tx.Query(context.Background(), `
+        SELECT variant_id, sum(quantity)
+        FROM order_items
+        WHERE order_id = $1 AND variant_id IS NOT NULL
+        GROUP BY variant_id
+    `, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	quantities := make(map[int]int)
+	for rows.Next() {
+		var variantID, quantity int
+		if err := rows.Scan(&variantID, &quantity); err != nil {
+			return nil, err
+		}
+		quantities[variantID] = quantity
+	}
+	return quantities, rows.Err()
+}
+
+func PlaceOrder(order *Order, items []*OrderItem) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	ordered := make(map[int]int)
+	for _, item := range items {
+		if item.VariantID != nil {
+			ordered[*item.VariantID] += item.Quantity
+		}
+	}
+	if err := takeVariantStock(tx, ordered); err != nil {
+		return err
+	}
+
 	query := `
-        INSERT INTO orders (user_id, total_amount, status)
-        VALUES ($1, $2, $3)
+        INSERT INTO orders (user_id, total_amount, status, shipping_address, billing_address)
+        VALUES ($1, $2, $3, $4, $5)
         RETURNING id, created_at
     `
-	row := db.QueryRow(context.Background(), query, order.UserID, order.TotalAmount, order.Status)
-	err := row.Scan(&order.ID, &order.CreatedAt)
+	err = tx.QueryRow(context.Background(), query, order.UserID, order.TotalAmount, order.Status, order.ShippingAddress, order.BillingAddress).
+		Scan(&order.ID, &order.CreatedAt)
 	if err != nil {
-		fmt.Println("Error creating order:", err)
 		return err
 	}
 
-	return nil
+	for _, item := range items {
+		item.OrderID = order.ID
+		query := `
+            INSERT INTO order_items (order_id, product_id, variant_id, sku, quantity, price)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            RETURNING id, created_at::text
+        `
+		err := tx.QueryRow(context.Background(), query, item.OrderID, item.ProductID, item.VariantID, item.SKU, item.Quantity, item.Price).
+			Scan(&item.ID, &item.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(context.Background())
 }
 
-func CreateOrderItem(orderItem *OrderItem) error {
+func GetOrderItemsByOrderID(orderID int) ([]OrderItem, error) {
+	var orderItems []OrderItem
+
 	query := `
-        INSERT INTO order_items (order_id, product_id, quantity, price)
-        VALUES ($1, $2, $3, $4)
-        RETURNING id, created_at
+        SELECT id, order_id, product_id, variant_id, sku, quantity, price, created_at::text
+        FROM order_items
+        WHERE order_id = $1
+        ORDER BY id
     `
-	row := db.QueryRow(context.Background(), query, orderItem.OrderID, orderItem.ProductID, orderItem.Quantity, orderItem.Price)
-	err := row.Scan(&orderItem.ID, &orderItem.CreatedAt)
+	rows, err := db.Query(context.Background(), query, orderID)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var orderItem OrderItem
+		err := rows.Scan(&orderItem.ID, &orderItem.OrderID, &orderItem.ProductID, &orderItem.VariantID, &orderItem.SKU, &orderItem.Quantity, &orderItem.Price, &orderItem.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		orderItems = append(orderItems, orderItem)
 	}
 
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return orderItems, nil
 }
 
-func UpdateOrder(order *Order) error {
-	query := `
-		UPDATE orders
-		SET status = $1
-		WHERE id = $2
-	`
-	_, err := db.Exec(context.Background(), query, order.Status, order.ID)
+// SetOrderStatus changes the status of the order from the status it was
+// read with. It returns false, without changing anything, if the status has
+// changed since. Cancelling an order puts its variants back in stock and
+// reopening a cancelled one takes them out again, in the same transaction.
+func SetOrderStatus(order *Order, from string) (bool, error) {
+	tx, err := db.Begin(context.Background())
 	if err != nil {
-		return fmt.Errorf("failed to update order: %v", err)
+		return false, err
 	}
-	return nil
+	defer tx.Rollback(context.Background())
+
+	tag, err := tx.Exec(context.Background(), "UPDATE orders SET status = $1 WHERE id = $2 AND status = $3", order.Status, order.ID, from)
+	if err != nil {
+		return false, fmt.Errorf("failed to update order: %v", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if (from == "cancelled") != (order.Status == "cancelled") {
+		quantities, err := orderedVariantQuantities(tx, order.ID)
+		if err != nil {
+			return false, err
+		}
+		if order.Status == "cancelled" {
+			err = returnVariantStock(tx, quantities)
+		} else {
+			err = takeVariantStock(tx, quantities)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit(context.Background())
 }
 
-func DeleteOrder(orderID int) error {
-	query := `
-		DELETE FROM orders
-		WHERE id = $1
-	`
-	_, err := db.Exec(context.Background(), query, orderID)
+// DeleteOrder deletes the order and, unless it was cancelled already, puts
+// its variants back in stock. It returns false if the order doesn't exist.
+func DeleteOrder(orderID int) (bool, error) {
+	tx, err := db.Begin(context.Background())
 	if err != nil {
-		return fmt.Errorf("failed to delete order: %v", err)
+		return false, err
 	}
-	return nil
+	defer tx.Rollback(context.Background())
+
+	var status string
+	err = tx.QueryRow(context.Background(), "SELECT status FROM orders WHERE id = $1 FOR UPDATE", orderID).Scan(&status)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if status != "cancelled" {
+		quantities, err := orderedVariantQuantities(tx, orderID)
+		if err != nil {
+			return false, err
+		}
+		if err := returnVariantStock(tx, quantities); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM orders WHERE id = $1", orderID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete order: %v", err)
+	}
+
+	return true, tx.Commit(context.Background())
 }
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// ProductOption is one dimension a product varies in, with its allowed
+// values in display order.
+type ProductOption struct {
+	ID        int      `json:"id"`
+	ProductID int      `json:"-"`
+	Name      string   `json:"name"`
+	Values    []string `json:"values"`
+	Position  int      `json:"position"`
+}
+
+// ProductVariant is one sellable combination of option values.
+type ProductVariant struct {
+	ID        int    `json:"id"`
+	ProductID int    `json:"product_id"`
+	SKU       string `json:"sku"`
+	// Options maps each option name of the product to one of its values.
+	Options map[string]string `json:"options"`
+	// Price overrides the product's price when set.
+	Price         *float64  `json:"price"`
+	StockQuantity int       `json:"stock_quantity"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// UnitPrice is the variant's price, falling back to the product's.
+func (v *ProductVariant) UnitPrice(product *Product) float64 {
+	if v.Price != nil {
+		return *v.Price
+	}
+	return product.Price
+}
+
+const variantColumns = `id, product_id, sku, options, price::float8, stock_quantity, created_at`
+
+func scanVariant(row pgx.Row, variant *ProductVariant) error {
+	return row.Scan(&variant.ID, &variant.ProductID, &variant.SKU, &variant.Options, &variant.Price, &variant.StockQuantity, &variant.CreatedAt)
+}
+
+// GetProductOptions returns the options of each of the products, by
+// product ID.
+func GetProductOptions(productIDs []int) (map[int][]ProductOption, error) {
+	query := `
+        SELECT id, product_id, name, option_values, position
+        FROM product_options
+        WHERE product_id = ANY($1)
+        ORDER BY product_id, position, id
+    `
+	rows, err := db.Query(context.Background(), query, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	options := make(map[int][]ProductOption)
+	for rows.Next() {
+		var option ProductOption
+		if err := rows.Scan(&option.ID, &option.ProductID, &option.Name, &option.Values, &option.Position); err != nil {
+			return nil, err
+		}
+		options[option.ProductID] = append(options[option.ProductID], option)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// SetProductOptions replaces the option definitions of the product. The
+// position of each option is its index.
+func SetProductOptions(productID int, options []ProductOption) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM product_options WHERE product_id = $1", productID)
+	if err != nil {
+		return err
+	}
+	for i := range options {
+		options[i].ProductID = productID
+		options[i].Position = i
+		err := tx.QueryRow(context.Background(), `
+            INSERT INTO product_options (product_id, name, option_values, position)
+            VALUES ($1, $2, $3, $4)
+            RETURNING id
+        `, productID, options[i].Name, options[i].Values, i).Scan(&options[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(context.Background())
+}
+
+// GetProductVariants returns the variants of each of the products, by
+// product ID.
+func GetProductVariants(productIDs []int) (map[int][]*ProductVariant, error) {
+	query := `
+        SELECT ` + variantColumns + `
+        FROM product_variants
+        WHERE product_id = ANY($1)
+        ORDER BY product_id, id
+    `
+	rows, err := db.Query(context.Background(), query, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := make(map[int][]*ProductVariant)
+	for rows.Next() {
+		var variant ProductVariant
+		if err := scanVariant(rows, &variant); err != nil {
+			return nil, err
+		}
+		variants[variant.ProductID] = append(variants[variant.ProductID], &variant)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return variants, nil
+}
+
+// GetProductVariant returns nil, nil if the variant doesn't exist or belongs
+// to another product.
+func GetProductVariant(productID, variantID int) (*ProductVariant, error) {
+	var variant ProductVariant
+
+	query := `
+        SELECT ` + variantColumns + `
+        FROM product_variants
+        WHERE id = $1 AND product_id = $2
+    `
+	err := scanVariant(db.QueryRow(context.Background(), query, variantID, productID), &variant)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &variant, nil
+}
+
+func CreateProductVariant(variant *ProductVariant) error {
+	query := `
+        INSERT INTO product_variants (product_id, sku, options, price, stock_quantity)
+        VALUES ($1, $2, $3, $4, $5)
+        RETURNING id, created_at
+    `
+	return db.QueryRow(context.Background(), query, variant.ProductID, variant.SKU, variant.Options, variant.Price, variant.StockQuantity).
+		Scan(&variant.ID, &variant.CreatedAt)
+}
+
+// UpdateProductVariant returns false if the variant doesn't exist or belongs
+// to another product.
+func UpdateProductVariant(variant *ProductVariant) (bool, error) {
+	query := `
+        UPDATE product_variants
+        SET sku = $1, options = $2, price = $3, stock_quantity = $4
+        WHERE id = $5 AND product_id = $6
+        RETURNING created_at
+    `
+	err := db.QueryRow(context.Background(), query, variant.SKU, variant.Options, variant.Price, variant.StockQuantity, variant.ID, variant.ProductID).
+		Scan(&variant.CreatedAt)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// DeleteProductVariant also removes the variant from carts. Orders keep its
+// SKU.
+func DeleteProductVariant(productID, variantID int) (bool, error) {
+	tag, err := db.Exec(context.Background(), "DELETE FROM product_variants WHERE id = $1 AND product_id = $2", variantID, productID)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}